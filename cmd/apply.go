@@ -0,0 +1,65 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "make the current resources match the config with incremental changes",
+	Run: func(cmd *cobra.Command, args []string) {
+		lockState()
+
+		ctx, stop := interruptContext()
+		defer stop()
+
+		s, plan, err := planResources(configPath)
+		if err != nil {
+			log.Errorf(err.Error())
+			os.Exit(1)
+		}
+
+		fmt.Println(plan.String())
+		if len(plan.Operations) == 0 {
+			return
+		}
+
+		// The state is saved even on failure, since the operations before the failed one have been made.
+		applyErr := plan.Apply(ctx, s)
+		if err := s.SaveState(); err != nil {
+			log.Errorf(err.Error())
+			os.Exit(1)
+		}
+
+		if applyErr != nil {
+			log.Errorf(applyErr.Error())
+			os.Exit(1)
+		}
+
+		log.Info("succeeded to apply")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(applyCmd)
+
+	applyCmd.Flags().StringVarP(&configPath, "config", "c", "", "config path")
+	applyCmd.MarkFlagRequired("config")
+}
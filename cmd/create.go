@@ -15,42 +15,69 @@ package cmd
 
 import (
 	"io/ioutil"
+	"os"
 
 	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/doctor"
 	"github.com/Shikugawa/ayame/pkg/state"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 var (
-	configPath string
+	configPath    string
+	skipPreflight bool
 
 	createCmd = &cobra.Command{
 		Use:   "create",
 		Short: "Create network environment from config",
 		Run: func(cmd *cobra.Command, args []string) {
+			lockState()
+
+			// Creation is rolled back on interruption.
+			ctx, stop := interruptContext()
+			defer stop()
+
 			bytes, err := ioutil.ReadFile(configPath)
 			if err != nil {
 				log.Errorf(err.Error())
-				return
+				os.Exit(1)
 			}
 
 			cfg, err := config.ParseConfig(bytes)
 			if err != nil {
 				log.Errorf(err.Error())
-				return
+				os.Exit(1)
 			}
 
-			st, err := state.InitResources(cfg, false)
+			lab, err := configLab(cfg, configPath)
 			if err != nil {
 				log.Errorf(err.Error())
-				return
+				os.Exit(1)
+			}
+
+			if !skipPreflight {
+				checks := doctor.Run(ctx, cfg, lab)
+				printChecks(os.Stderr, checks, true)
+				if doctor.Failed(checks) {
+					log.Errorf("preflight checks failed. fix the problems above, or skip the checks with --skip-preflight")
+					os.Exit(1)
+				}
+			}
+
+			st, err := state.InitResources(ctx, cfg, lab)
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
 			}
 
 			log.Info("succeeded to initialize")
 
+			st.SetSource(configPath, bytes)
+
 			if err := st.SaveState(); err != nil {
 				log.Errorf(err.Error())
+				os.Exit(1)
 			}
 		},
 	}
@@ -61,4 +88,5 @@ func init() {
 
 	createCmd.Flags().StringVarP(&configPath, "config", "c", "", "config path")
 	createCmd.MarkFlagRequired("config")
+	createCmd.Flags().BoolVar(&skipPreflight, "skip-preflight", false, "create without checking the environment first")
 }
@@ -26,7 +26,19 @@ var (
 		Use:   "delete",
 		Short: "delete saved network envs",
 		Run: func(cmd *cobra.Command, args []string) {
-			if err := state.DisposeResources(); err != nil {
+			lockState()
+
+			// An interrupted deletion resumes on the next run.
+			ctx, stop := interruptContext()
+			defer stop()
+
+			lab, err := currentLab()
+			if err != nil {
+				log.Errorln(err.Error())
+				return
+			}
+
+			if err := state.DisposeResources(ctx, lab); err != nil {
 				log.Errorln(err.Error())
 				return
 			}
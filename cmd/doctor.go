@@ -0,0 +1,82 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/doctor"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "check that the host can run labs, or the lab of the config",
+	Run: func(cmd *cobra.Command, args []string) {
+		var cfg *config.Config
+		lab := ""
+
+		if configPath != "" {
+			bytes, err := ioutil.ReadFile(configPath)
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			cfg, err = config.ParseConfig(bytes)
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			lab, err = configLab(cfg, configPath)
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+		}
+
+		checks := doctor.Run(baseContext, cfg, lab)
+		printChecks(os.Stdout, checks, false)
+
+		if doctor.Failed(checks) {
+			os.Exit(1)
+		}
+	},
+}
+
+// printChecks prints the checks with their fixes. Passed checks are omitted if problemsOnly.
+func printChecks(w io.Writer, checks []doctor.Check, problemsOnly bool) {
+	for _, c := range checks {
+		if problemsOnly && c.Status == doctor.StatusOK {
+			continue
+		}
+
+		fmt.Fprintf(w, "[%s] %s: %s\n", c.Status, c.Name, c.Detail)
+		if c.Fix != "" {
+			fmt.Fprintf(w, "       fix: %s\n", c.Fix)
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+
+	doctorCmd.Flags().StringVarP(&configPath, "config", "c", "", "config path (default: check the host only)")
+}
@@ -0,0 +1,95 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	execCmd = &cobra.Command{
+		Use:   "exec NAMESPACE -- COMMAND...",
+		Short: "run a command inside the namespace",
+		Long: `Run a command inside the namespace of the current lab.
+Variables like $(veth1) or $(peer.ns2.veth1.ip) are expanded as in the config.`,
+		Args: cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			s, ns, err := loadNamespace(args[0])
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			netnsCmd, err := ns.BuildExecCommand(baseContext, args[1:], s.Namespaces)
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			os.Exit(runInteractive(netnsCmd, nil))
+		},
+	}
+)
+
+// loadNamespace finds the namespace from the saved state.
+func loadNamespace(name string) (*state.State, *network.Namespace, error) {
+	s, err := loadCurrentLab()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ns := s.FindNamespace(name)
+	if ns == nil {
+		return nil, nil, fmt.Errorf("namespace %s doesn't exist in the lab", name)
+	}
+
+	return s, ns, nil
+}
+
+// runInteractive runs the command with stdio of ayame, and returns its exit code.
+func runInteractive(args []string, env []string) int {
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if env != nil {
+		c.Env = env
+	}
+
+	// Signals from the terminal are delivered to the child directly.
+	signal.Ignore(os.Interrupt)
+	defer signal.Reset(os.Interrupt)
+
+	if err := c.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		log.Errorf(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/export"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportFormat string
+	exportOutput string
+
+	exportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "export the lab as standalone scripts",
+		Long: `Render the operations of creating the lab from the config as a bash script which runs without ayame,
+and a teardown script undoing them. Both scripts skip what has been done already, so they can be run again.
+They are written as LAB-create.sh and LAB-teardown.sh in the output directory.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if exportFormat != export.FormatShell {
+				log.Errorf("unknown format %s, expected %s", exportFormat, export.FormatShell)
+				os.Exit(1)
+			}
+
+			bytes, err := ioutil.ReadFile(configPath)
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			cfg, err := config.ParseConfig(bytes)
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			lab, err := configLab(cfg, configPath)
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			// The operations are only rendered, so they are not logged.
+			log.SetLevel(log.WarnLevel)
+
+			create, teardown, err := export.Scripts(cfg, lab)
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			var paths []string
+			for name, script := range map[string]string{"create": create, "teardown": teardown} {
+				path := filepath.Join(exportOutput, fmt.Sprintf("%s-%s.sh", lab, name))
+				if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+					log.Errorf(err.Error())
+					os.Exit(1)
+				}
+				paths = append(paths, path)
+			}
+
+			// Paths are printed in a stable order.
+			sort.Strings(paths)
+			for _, path := range paths {
+				fmt.Println(path)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().StringVarP(&configPath, "config", "c", "", "config path")
+	exportCmd.MarkFlagRequired("config")
+	exportCmd.Flags().StringVar(&exportFormat, "format", export.FormatShell, "format of the scripts, only sh is supported")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", ".", "directory to write the scripts")
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Shikugawa/ayame/pkg/state"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	gcDryRun bool
+
+	gcCmd = &cobra.Command{
+		Use:   "gc",
+		Short: "delete resources created by ayame but not in the state",
+		Run: func(cmd *cobra.Command, args []string) {
+			lockState()
+
+			ctx, stop := interruptContext()
+			defer stop()
+
+			orphans, err := state.FindOrphans(ctx)
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			if len(orphans) == 0 {
+				fmt.Println("no orphaned resources")
+				return
+			}
+
+			for _, o := range orphans {
+				fmt.Println(o.String())
+			}
+
+			if gcDryRun {
+				return
+			}
+
+			if err := state.DeleteOrphans(ctx, orphans); err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			log.Infof("deleted %d resources", len(orphans))
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+
+	gcCmd.Flags().BoolVar(&gcDryRun, "dry-run", false, "only show the resources to be deleted")
+}
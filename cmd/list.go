@@ -0,0 +1,65 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/state"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list all the labs",
+	Run: func(cmd *cobra.Command, args []string) {
+		labs, err := state.ListLabs()
+		if err != nil {
+			log.Errorf(err.Error())
+			os.Exit(1)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tNAMESPACES\tDIRECT LINKS\tBRIDGES\tCREATED")
+		for _, lab := range labs {
+			if state.Interrupted(lab) {
+				fmt.Fprintf(w, "%s\t-\t-\t-\tinterrupted, run `ayame delete --lab %s`\n", lab, lab)
+				continue
+			}
+
+			s, err := state.LoadResources(lab)
+			if err != nil {
+				// Corrupt labs are shown to be fixed.
+				fmt.Fprintf(w, "%s\t-\t-\t-\t%s\n", lab, err)
+				continue
+			}
+			sum := s.Summary()
+
+			created := "-"
+			if sum.CreatedAt != nil {
+				created = sum.CreatedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", sum.Name, sum.Namespaces, sum.DirectLinks, sum.Bridges, created)
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+}
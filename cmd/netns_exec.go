@@ -0,0 +1,40 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"os"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// netnsExecCmd is invoked by ayame itself to run commands inside namespaces with the netlink backend.
+var netnsExecCmd = &cobra.Command{
+	Use:    network.NetnsExecCommand + " NETNS -- COMMAND...",
+	Short:  "run a command inside the network namespace",
+	Hidden: true,
+	Args:   cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := network.ExecInNamespace(args[0], args[1:]); err != nil {
+			log.Errorf(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(netnsExecCmd)
+}
@@ -0,0 +1,181 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pingAll     bool
+	pingCount   int
+	pingTimeout time.Duration
+
+	pingCmd = &cobra.Command{
+		Use:   "ping [--all | SRC DST]",
+		Short: "check reachability between namespaces",
+		Long: `Send ICMP echo requests between namespaces of the current lab.
+SRC DST probes all the addresses of DST from SRC, and fails if none of them replies.
+--all prints a reachability matrix of all the namespaces, and fails if namespaces
+attached to the same link can't reach each other or expectations in the config fail.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if pingAll == (len(args) == 2) {
+				cmd.Usage()
+				os.Exit(1)
+			}
+
+			s, err := loadCurrentLab()
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			var ok bool
+			if pingAll {
+				ok = pingMatrix(s)
+			} else {
+				ok = pingPair(s, args[0], args[1])
+			}
+
+			if !ok {
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+type pingResult struct {
+	addr net.IP
+	rtt  time.Duration
+	err  error
+}
+
+// pingNamespace probes all the addresses of dst from src.
+func pingNamespace(src, dst *network.Namespace) []pingResult {
+	var results []pingResult
+	for _, addr := range dst.Addresses() {
+		res := pingResult{addr: addr}
+		for seq := 0; seq < pingCount; seq++ {
+			rtt, err := network.Ping(src.NetnsName(), addr, seq, pingTimeout)
+			res.rtt, res.err = rtt, err
+			if err == nil {
+				break
+			}
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+func pingPair(s *state.State, srcName, dstName string) bool {
+	src := s.FindNamespace(srcName)
+	if src == nil {
+		log.Errorf("namespace %s doesn't exist in the lab", srcName)
+		return false
+	}
+	dst := s.FindNamespace(dstName)
+	if dst == nil {
+		log.Errorf("namespace %s doesn't exist in the lab", dstName)
+		return false
+	}
+
+	reachable := false
+	for _, res := range pingNamespace(src, dst) {
+		if res.err != nil {
+			fmt.Printf("%s -> %s (%s): unreachable: %s\n", src.Name, dst.Name, res.addr, res.err)
+			continue
+		}
+		fmt.Printf("%s -> %s (%s): %s\n", src.Name, dst.Name, res.addr, res.rtt)
+		reachable = true
+	}
+
+	return reachable
+}
+
+func pingMatrix(s *state.State) bool {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprint(w, "SRC\\DST")
+	for _, dst := range s.Namespaces {
+		fmt.Fprintf(w, "\t%s", dst.Name)
+	}
+	fmt.Fprintln(w)
+
+	var failures []string
+	for _, src := range s.Namespaces {
+		fmt.Fprint(w, src.Name)
+		for _, dst := range s.Namespaces {
+			if src == dst {
+				fmt.Fprint(w, "\t-")
+				continue
+			}
+
+			cell := "x"
+			for _, res := range pingNamespace(src, dst) {
+				if res.err == nil {
+					cell = fmt.Sprintf("%.2fms", float64(res.rtt.Microseconds())/1000)
+					break
+				}
+			}
+
+			if cell == "x" && src.SharesLinkWith(dst) {
+				cell = "x!"
+				failures = append(failures, fmt.Sprintf("%s -> %s", src.Name, dst.Name))
+			}
+			fmt.Fprintf(w, "\t%s", cell)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+
+	ok := true
+	if len(failures) != 0 {
+		fmt.Println()
+		fmt.Println("unreachable namespaces on the same link (x!):")
+		for _, f := range failures {
+			fmt.Printf("  %s\n", f)
+		}
+		ok = false
+	}
+
+	if len(s.Expectations) != 0 {
+		fmt.Println()
+		fmt.Println("expectations:")
+		for _, res := range s.EvaluateExpectations(s.Expectations, pingTimeout) {
+			if !res.Passed {
+				ok = false
+			}
+			fmt.Printf("  %s %s: %s\n", res.Status(), res.Expect.String(), res.Detail)
+		}
+	}
+
+	return ok
+}
+
+func init() {
+	rootCmd.AddCommand(pingCmd)
+
+	pingCmd.Flags().BoolVar(&pingAll, "all", false, "probe all the pairs of namespaces")
+	pingCmd.Flags().IntVar(&pingCount, "count", 3, "max number of echo requests for each address")
+	pingCmd.Flags().DurationVar(&pingTimeout, "timeout", time.Second, "timeout of each echo request")
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/state"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "show changes to make the current resources match the config",
+	Run: func(cmd *cobra.Command, args []string) {
+		_, plan, err := planResources(configPath)
+		if err != nil {
+			log.Errorf(err.Error())
+			os.Exit(1)
+		}
+
+		fmt.Println(plan.String())
+	},
+}
+
+// planResources diffs the config against the saved state. Without state, everything is added.
+func planResources(path string) (*state.State, *state.Plan, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err := config.ParseConfig(bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lab, err := configLab(cfg, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s, err := state.LoadResources(lab)
+	if err == state.ErrNoResources {
+		s, err = &state.State{Lab: lab}, state.CheckLabPrefix(lab)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plan, err := state.PlanResources(cfg, s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// It is saved by apply.
+	s.SetSource(path, bytes)
+	return s, plan, nil
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+
+	planCmd.Flags().StringVarP(&configPath, "config", "c", "", "config path")
+	planCmd.MarkFlagRequired("config")
+}
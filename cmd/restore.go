@@ -0,0 +1,111 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/template"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	restoreUnit bool
+
+	restoreCmd = &cobra.Command{
+		Use:   "restore",
+		Short: "create the resources of the saved lab again, e.g. after reboot",
+		Long: `Create the namespaces, veths and bridges of the saved lab which have gone, e.g. after reboot,
+then run the commands and add the routes again in the namespaces created, and start the services
+which aren't running. Resources which exist are kept, so it can be run again after a failure.
+
+With --systemd-unit, it prints a systemd unit which restores the lab at boot instead.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			lab, err := currentLab()
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			if restoreUnit {
+				if err := printRestoreUnit(lab); err != nil {
+					log.Errorf(err.Error())
+					os.Exit(1)
+				}
+				return
+			}
+
+			lockState()
+
+			ctx, stop := interruptContext()
+			defer stop()
+
+			if _, err := state.RestoreResources(ctx, lab); err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			log.Infof("succeeded to restore lab %s", lab)
+		},
+	}
+)
+
+var restoreUnitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=Restore ayame lab {{.Lab}}
+Wants=network-online.target
+After=network-online.target openvswitch-switch.service ovsdb-server.service
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart={{.Exec}} restore --lab {{.Lab}} --state-dir {{.StateDir}}{{if .Backend}} --backend {{.Backend}}{{end}}
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// printRestoreUnit prints the systemd unit restoring the lab, to be installed e.g. as
+// /etc/systemd/system/ayame-LAB.service.
+func printRestoreUnit(lab string) error {
+	if !state.ResourcesSaved(lab) {
+		return fmt.Errorf("no resources in lab %s", lab)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	backend := ""
+	if backendName != network.BackendIproute2 {
+		backend = backendName
+	}
+
+	return restoreUnitTemplate.Execute(os.Stdout, struct {
+		Lab      string
+		Exec     string
+		StateDir string
+		Backend  string
+	}{lab, self, state.StateDir(), backend})
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+
+	restoreCmd.Flags().BoolVar(&restoreUnit, "systemd-unit", false, "print a systemd unit restoring the lab at boot")
+}
@@ -14,23 +14,148 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
+	"github.com/Shikugawa/ayame/pkg/version"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+var (
+	labName        string
+	stateDir       string
+	commandTimeout time.Duration
+	backendName    string
+	parallelism    int
+
+	// baseContext carries the backend, the timeout and the parallelism given by the flags.
+	baseContext = context.Background()
+)
+
 func init() {
 	log.SetFormatter(&log.TextFormatter{})
 	log.SetOutput(os.Stdout)
 	log.SetLevel(log.InfoLevel)
+
+	rootCmd.PersistentFlags().StringVar(&stateDir, "state-dir", "",
+		fmt.Sprintf("directory of the state (default: $%s or %s)", state.StateDirEnv, state.DefaultStateDir))
+	rootCmd.PersistentFlags().StringVar(&labName, "lab", "", "name of the lab (default: the only lab, or the name from the config)")
+	rootCmd.PersistentFlags().DurationVar(&commandTimeout, "command-timeout", 0,
+		"timeout of each command executed by ayame, e.g. 30s (default: no timeout)")
+	rootCmd.PersistentFlags().StringVar(&backendName, "backend", network.BackendIproute2,
+		fmt.Sprintf("how to configure the network, %s or %s", network.BackendIproute2, network.BackendNetlink))
+	rootCmd.PersistentFlags().IntVar(&parallelism, "parallelism", runtime.NumCPU(),
+		"number of operations run at the same time while creating a lab")
+}
+
+// configLab returns the lab given by --lab, or the one named in the config.
+func configLab(cfg *config.Config, path string) (string, error) {
+	lab := labName
+	if lab == "" {
+		lab = config.LabName(cfg, path)
+	}
+
+	if err := config.ValidateLabName(lab); err != nil {
+		return "", err
+	}
+	return lab, nil
+}
+
+// currentLab returns the lab given by --lab, or the only saved lab.
+func currentLab() (string, error) {
+	if labName != "" {
+		return labName, nil
+	}
+
+	labs, err := state.ListLabs()
+	if err != nil {
+		return "", err
+	}
+
+	switch len(labs) {
+	case 0:
+		return "", fmt.Errorf("no resources")
+	case 1:
+		return labs[0], nil
+	default:
+		return "", fmt.Errorf("specify one of the labs with --lab: %s", strings.Join(labs, ", "))
+	}
+}
+
+// loadCurrentLab loads the state of the current lab.
+func loadCurrentLab() (*state.State, error) {
+	lab, err := currentLab()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := state.LoadResources(lab)
+	if err == state.ErrNoResources {
+		return nil, fmt.Errorf("no resources in lab %s", lab)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// lockState takes the lock of the state for the commands changing labs.
+// It is released on exit.
+func lockState() {
+	if err := state.Lock(); err != nil {
+		log.Errorf(err.Error())
+		os.Exit(1)
+	}
+}
+
+// interruptContext returns the context cancelled by SIGINT or SIGTERM, so that the command
+// can roll back or save what it has done. Another signal kills ayame immediately.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(baseContext)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Warnf("received %s, stopping. send it again to exit immediately", sig)
+			signal.Stop(sigs)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigs)
+		cancel()
+	}
 }
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
-	Use:   "ayame",
-	Short: "A simple network laboratory builder with Linux namespaces",
+	Use:     "ayame",
+	Short:   "A simple network laboratory builder with Linux namespaces",
+	Version: version.String(),
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		state.SetStateDir(stateDir)
+		ctx, err := network.WithBackend(context.Background(), backendName)
+		if err != nil {
+			log.Errorf(err.Error())
+			os.Exit(1)
+		}
+		ctx = network.WithCommandTimeout(ctx, commandTimeout)
+		baseContext = network.WithParallelism(ctx, parallelism)
+	},
 }
 
 func Execute() {
@@ -0,0 +1,93 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/Shikugawa/ayame/pkg/scenario"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	transcriptPath string
+
+	scenarioCmd = &cobra.Command{
+		Use:   "scenario",
+		Short: "run step-by-step experiments against the current lab",
+	}
+
+	scenarioRunCmd = &cobra.Command{
+		Use:   "run FILE",
+		Short: "run the scenario file",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			bytes, err := ioutil.ReadFile(args[0])
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			sc, err := scenario.ParseScenario(bytes)
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			s, err := loadCurrentLab()
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			var out io.Writer = os.Stdout
+			if transcriptPath != "" {
+				f, err := os.Create(transcriptPath)
+				if err != nil {
+					log.Errorf(err.Error())
+					os.Exit(1)
+				}
+				defer f.Close()
+				out = io.MultiWriter(os.Stdout, f)
+			}
+
+			ctx, stop := interruptContext()
+			defer stop()
+
+			runner := &scenario.Runner{State: s, Out: out}
+			failures := runner.Run(ctx, sc)
+			if len(failures) == 0 {
+				fmt.Fprintln(out, "all steps passed")
+				return
+			}
+
+			fmt.Fprintln(out, "failed steps:")
+			for _, f := range failures {
+				fmt.Fprintf(out, "  step %d (%s): %s\n", f.Step, f.Description, f.Reason)
+			}
+			os.Exit(1)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(scenarioCmd)
+	scenarioCmd.AddCommand(scenarioRunCmd)
+
+	scenarioRunCmd.Flags().StringVar(&transcriptPath, "transcript", "", "also write the transcript to the path")
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	shellPath string
+
+	shellCmd = &cobra.Command{
+		Use:   "shell NAMESPACE",
+		Short: "open an interactive shell inside the namespace",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			_, ns, err := loadNamespace(args[0])
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			sh := shellPath
+			if sh == "" {
+				sh = os.Getenv("SHELL")
+			}
+			if sh == "" {
+				sh = "/bin/sh"
+			}
+
+			prompt := fmt.Sprintf("(ayame:%s) ", ns.Name)
+			env := append(os.Environ(), "AYAME_NAMESPACE="+ns.Name, "PS1="+prompt+`\u@\h:\w\$ `)
+			shArgs := []string{sh}
+
+			// bash overwrites PS1 with .bashrc, so the prompt is prepended after loading it.
+			rcfile := ""
+			if filepath.Base(sh) == "bash" {
+				f, err := ioutil.TempFile("", "ayame-bashrc-")
+				if err != nil {
+					log.Errorf(err.Error())
+					os.Exit(1)
+				}
+				// The prompt is quoted for bash, so that it is never expanded.
+				fmt.Fprintf(f, "[ -f ~/.bashrc ] && . ~/.bashrc\nPS1=%s\"$PS1\"\n", network.ShellQuote(prompt))
+				f.Close()
+
+				rcfile = f.Name()
+				shArgs = append(shArgs, "--rcfile", rcfile)
+			}
+
+			netnsCmd, err := ns.BuildExecCommand(baseContext, shArgs, nil)
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			code := runInteractive(netnsCmd, env)
+			if rcfile != "" {
+				os.Remove(rcfile)
+			}
+			os.Exit(code)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(shellCmd)
+
+	shellCmd.Flags().StringVarP(&shellPath, "shell", "s", "", "shell to run (default $SHELL)")
+}
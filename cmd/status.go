@@ -14,35 +14,98 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"text/tabwriter"
 
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 
 	"github.com/Shikugawa/ayame/pkg/state"
 	"github.com/spf13/cobra"
 )
 
+var (
+	statusOutput string
+	statusDrift  bool
+	statusRaw    bool
+)
+
+// driftExitCode is used with --drift if resources are missing, modified or down.
+const driftExitCode = 2
+
 // statusCmd represents the status command
 var statusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "get current resources",
 	Run: func(cmd *cobra.Command, args []string) {
-		s := state.LoadResources()
-		if s == nil {
-			log.Errorf("no resources")
-			return
-		}
-
-		ls, err := s.DumpAll()
+		s, err := loadCurrentLab()
 		if err != nil {
 			log.Errorf(err.Error())
+			os.Exit(1)
+		}
+
+		if statusRaw {
+			s.RefreshServices()
+
+			ls, err := s.DumpAll()
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+
+			fmt.Println(ls)
 			return
 		}
 
-		fmt.Println(ls)
+		status := s.Inspect(baseContext)
+
+		switch statusOutput {
+		case "table":
+			printStatusTable(status)
+		case "json":
+			b, err := json.MarshalIndent(status, "", "  ")
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+			fmt.Println(string(b))
+		case "yaml":
+			b, err := yaml.Marshal(status)
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
+			fmt.Print(string(b))
+		default:
+			log.Errorf("unknown output format %s", statusOutput)
+			os.Exit(1)
+		}
+
+		if statusDrift && status.Drift {
+			os.Exit(driftExitCode)
+		}
 	},
 }
 
+func printStatusTable(status *state.LiveStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAME\tSTATUS\tSTATE\tDETAIL")
+	for _, r := range status.Resources {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Kind, r.Name, r.Status, r.State, r.Detail)
+	}
+	w.Flush()
+
+	if status.Drift {
+		fmt.Println("\ndrift detected")
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(statusCmd)
+
+	statusCmd.Flags().StringVarP(&statusOutput, "output", "o", "table", "output format: table, json or yaml")
+	statusCmd.Flags().BoolVar(&statusDrift, "drift", false, fmt.Sprintf("exit with %d if resources are missing, modified or down", driftExitCode))
+	statusCmd.Flags().BoolVar(&statusRaw, "raw", false, "print the saved state as it is")
 }
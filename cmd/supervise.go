@@ -0,0 +1,48 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	superviseLogPath string
+	superviseRestart string
+
+	// superviseCmd is invoked by ayame itself to keep services running in background.
+	superviseCmd = &cobra.Command{
+		Use:    network.SuperviseCommand + " -- COMMAND...",
+		Short:  "supervise a service process",
+		Hidden: true,
+		Args:   cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := network.Supervise(args, config.RestartPolicy(superviseRestart), superviseLogPath); err != nil {
+				log.Errorf(err.Error())
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(superviseCmd)
+
+	superviseCmd.Flags().StringVar(&superviseLogPath, "log", "", "log file path")
+	superviseCmd.MarkFlagRequired("log")
+
+	superviseCmd.Flags().StringVar(&superviseRestart, "restart", config.RestartNever, "restart policy")
+}
@@ -14,164 +14,429 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
 	"github.com/Shikugawa/ayame/pkg/state"
-	"github.com/r3labs/diff"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 const (
-	dataName = "config.yml"
-	refName  = "state.json"
+	dataName          = "config.yml"
+	refName           = "state.json"
+	transcriptName    = "commands.txt"
+	expectedErrorName = "expected_error"
 )
 
 var (
 	datasetPath string
 	test        string
+	live        bool
+	liveTimeout time.Duration
+	update      bool
+	junitPath   string
+	jsonPath    string
 
 	testCmd = &cobra.Command{
 		Use:   "test",
 		Short: "run tests",
+		Long: `Run tests for datasets under the path. A dataset is a directory which has config.yml.
+
+The dataset must fail to create if it has an expected_error file, whose content is
+a regular expression matched with the error. Datasets named with "-fail" must have it.
+Otherwise the created state must be equal to state.json in the dataset.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			testdata := make(map[string][]string)
+			if live {
+				lockState()
+			}
 
-			if err := filepath.Walk(datasetPath, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
+			ctx, stop := interruptContext()
+			defer stop()
 
-				if info.IsDir() {
-					if _, ok := testdata[info.Name()]; !ok {
-						testdata[info.Name()] = []string{}
-					}
-					return nil
-				}
-
-				splited := strings.Split(path, "/")
+			datasets, err := findDatasets(datasetPath)
+			if err != nil {
+				log.Errorf(err.Error())
+				os.Exit(1)
+			}
 
-				if len(splited) < 2 {
-					return nil
+			var results []*testResult
+			for _, dir := range datasets {
+				if len(test) != 0 && test != filepath.Base(dir) {
+					continue
+				}
+				if ctx.Err() != nil {
+					log.Warnf("interrupted, skip the rest of tests")
+					break
 				}
 
-				fileName := splited[len(splited)-1]
-				parentDir := splited[len(splited)-2]
-
-				if _, ok := testdata[parentDir]; ok {
-					if fileName == dataName || fileName == refName {
-						testdata[parentDir] = append(testdata[parentDir], path)
+				log.Infof("================ start test: %s ================", filepath.Base(dir))
+				res := runTest(ctx, dir)
+				if res.Passed {
+					log.Infof("================ test %s OK ================", res.Name)
+				} else {
+					log.Errorf("================ test %s FAILED: %s ================", res.Name, res.Message)
+					for _, d := range res.Details {
+						log.Errorln(d)
 					}
 				}
+				results = append(results, res)
+			}
 
-				return nil
-			}); err != nil {
+			if len(results) == 0 {
+				log.Errorf("no test found in %s", datasetPath)
+				os.Exit(1)
+			}
+
+			if err := writeReports(results); err != nil {
 				log.Errorf(err.Error())
+				os.Exit(1)
 			}
 
-			for testName, paths := range testdata {
-				if len(paths) == 0 {
-					continue
+			failed := 0
+			for _, res := range results {
+				if !res.Passed {
+					failed++
 				}
+			}
+			log.Infof("%d passed, %d failed", len(results)-failed, failed)
 
-				if len(test) != 0 && test != testName {
-					continue
-				}
+			if failed != 0 {
+				os.Exit(1)
+			}
+		},
+	}
+)
 
-				splited := strings.Split(testName, "-")
-				if len(splited) != 2 {
-					log.Errorf("invalid testname format: %s", testName)
-					continue
-				}
+// findDatasets returns directories which have config.yml in lexical order.
+func findDatasets(root string) ([]string, error) {
+	var datasets []string
+	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() && info.Name() == dataName {
+			datasets = append(datasets, filepath.Dir(path))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
 
-				shouldSuccess := splited[1] == "ok"
+	sort.Strings(datasets)
+	return datasets, nil
+}
 
-				var cfg []byte
-				var ref []byte
+func runTest(ctx context.Context, dir string) *testResult {
+	start := time.Now()
+	res := &testResult{Name: filepath.Base(dir)}
+	defer func() {
+		res.Duration = time.Since(start).Seconds()
+	}()
+
+	cfg, err := ioutil.ReadFile(filepath.Join(dir, dataName))
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
 
-				for _, path := range paths {
-					if strings.HasSuffix(path, "/"+dataName) {
-						bytes, err := ioutil.ReadFile(path)
-						if err != nil {
-							log.Errorf("failed to read file: %s", path)
-							continue
-						}
-						cfg = bytes
-						continue
-					}
+	var expectedError *regexp.Regexp
+	if b, err := ioutil.ReadFile(filepath.Join(dir, expectedErrorName)); err == nil {
+		expectedError, err = regexp.Compile(strings.TrimSpace(string(b)))
+		if err != nil {
+			res.Message = fmt.Sprintf("invalid %s: %s", expectedErrorName, err)
+			return res
+		}
+	}
+	shouldFail := expectedError != nil
+	// The name used to be the expectation, which hides a missing or misspelled expected_error.
+	if !shouldFail && strings.HasSuffix(res.Name, "-fail") {
+		res.Message = fmt.Sprintf("dataset named with -fail must have %s", expectedErrorName)
+		return res
+	}
 
-					if strings.HasSuffix(path, "/"+refName) {
-						bytes, err := ioutil.ReadFile(path)
-						if err != nil {
-							log.Errorf("failed to read file: %s", path)
-							continue
-						}
-						ref = bytes
-						continue
-					}
-				}
+	// Datasets are only recorded without --live.
+	executor := &network.DryRunExecutor{}
+	if !live {
+		ctx = network.WithExecutor(ctx, executor)
+	}
 
-				if len(cfg) != 0 && len(ref) != 0 {
-					log.Infof("================ start test: %s ================", testName)
+	s, err := createDataset(ctx, cfg, dir)
+	if err != nil {
+		switch {
+		case !shouldFail:
+			res.Message = fmt.Sprintf("unexpected error: %s", err)
+		case expectedError != nil && !expectedError.MatchString(err.Error()):
+			res.Message = fmt.Sprintf("error %q doesn't match %q", err.Error(), expectedError.String())
+		default:
+			log.Infof("failed with error: %s", err.Error())
+			res.Passed = true
+		}
+		return res
+	}
 
-					c, err := config.ParseConfig(cfg)
-					if err != nil {
-						log.Errorf(err.Error())
-						continue
-					}
+	if live {
+		return runLiveTest(res, s, shouldFail)
+	}
 
-					s, err := state.InitResources(c, true)
-					if err != nil {
-						if !shouldSuccess {
-							log.Infof("failed with error: %s", err.Error())
-							log.Infof("================ test %s OK ================", testName)
-						} else {
-							log.Errorf(err.Error())
-						}
+	if shouldFail {
+		res.Message = "succeeded unexpectedly"
+		return res
+	}
 
-						continue
-					}
+	res = compareGolden(res, s, filepath.Join(dir, refName))
+	if !res.Passed {
+		return res
+	}
+	return compareTranscript(res, executor.Transcript(), filepath.Join(dir, transcriptName))
+}
 
-					ls, err := s.DumpAll()
-					if err != nil {
-						log.Errorf(err.Error())
-						continue
-					}
+func createDataset(ctx context.Context, cfg []byte, dir string) (*state.State, error) {
+	c, err := config.ParseConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-					expectedState := state.LoadStateFromBytes(ref)
-					if expectedState == nil {
-						continue
-					}
+	// Labs are named after the datasets, so that they don't collide with the others.
+	lab := c.Name
+	if lab == "" {
+		lab = filepath.Base(dir)
+	}
 
-					lsRef, err := expectedState.DumpAll()
-					if err != nil {
-						log.Errorf(err.Error())
-						continue
-					}
+	s, err := state.InitResources(ctx, c, lab)
+	if err != nil {
+		return nil, err
+	}
 
-					change, err := diff.Diff(ls, lsRef)
-					if err != nil {
-						log.Errorf(err.Error())
-						continue
-					}
+	// Expectations are evaluated from the config in live mode.
+	if live {
+		// Saved state allows `ayame delete` to clean up if the test is interrupted.
+		if err := s.SaveState(); err != nil {
+			log.Errorf(err.Error())
+		}
+	}
 
-					if len(change) != 0 {
-						log.Errorln(change)
-					} else {
-						log.Infof("================ test %s OK ================", testName)
-					}
+	return s, nil
+}
 
-				} else {
-					log.Errorf("================ failed to start test: %s ================", testName)
-				}
+func runLiveTest(res *testResult, s *state.State, shouldFail bool) *testResult {
+	defer func() {
+		// The lab is deleted even if the test is interrupted.
+		if err := state.DisposeResources(baseContext, s.Lab); err != nil {
+			res.Passed = false
+			res.Details = append(res.Details, fmt.Sprintf("failed to delete: %s", err))
+		}
+	}()
+
+	if shouldFail {
+		res.Message = "succeeded unexpectedly"
+		return res
+	}
+
+	failed := 0
+	for _, r := range s.EvaluateExpectations(s.Expectations, liveTimeout) {
+		if r.Passed {
+			log.Infof("PASS %s: %s", r.Expect.String(), r.Detail)
+			continue
+		}
+		failed++
+		res.Details = append(res.Details, fmt.Sprintf("%s %s: %s", r.Status(), r.Expect.String(), r.Detail))
+	}
+
+	if failed != 0 {
+		res.Message = fmt.Sprintf("%d expectations failed", failed)
+		return res
+	}
+
+	res.Passed = true
+	return res
+}
+
+func compareGolden(res *testResult, s *state.State, refPath string) *testResult {
+	ls, err := s.DumpAll()
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+
+	if update {
+		if err := ioutil.WriteFile(refPath, []byte(ls+"\n"), 0644); err != nil {
+			res.Message = err.Error()
+			return res
+		}
+		log.Infof("updated %s", refPath)
+		res.Passed = true
+		return res
+	}
+
+	ref, err := ioutil.ReadFile(refPath)
+	if err != nil {
+		res.Message = fmt.Sprintf("failed to read file: %s", refPath)
+		return res
+	}
+
+	expectedState, err := state.LoadStateFromBytes(ref)
+	if err != nil {
+		res.Message = fmt.Sprintf("failed to parse %s: %s", refPath, err)
+		return res
+	}
+
+	lsRef, err := expectedState.DumpAll()
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+
+	changes, err := diffJSON(lsRef, ls)
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+
+	if len(changes) != 0 {
+		res.Message = fmt.Sprintf("state differs from %s in %d places", refPath, len(changes))
+		res.Details = changes
+		return res
+	}
+
+	res.Passed = true
+	return res
+}
+
+// compareTranscript compares the executed commands with the transcript of the dataset line by line.
+// The transcript is written instead with --update, and the comparison is skipped if it doesn't exist.
+func compareTranscript(res *testResult, commands []string, refPath string) *testResult {
+	actual := strings.Join(commands, "\n") + "\n"
+
+	if update {
+		if err := ioutil.WriteFile(refPath, []byte(actual), 0644); err != nil {
+			res.Passed = false
+			res.Message = err.Error()
+			return res
+		}
+		log.Infof("updated %s", refPath)
+		return res
+	}
+
+	ref, err := ioutil.ReadFile(refPath)
+	if os.IsNotExist(err) {
+		return res
+	}
+	if err != nil {
+		res.Passed = false
+		res.Message = fmt.Sprintf("failed to read file: %s", refPath)
+		return res
+	}
+
+	expected := strings.Split(strings.TrimRight(string(ref), "\n"), "\n")
+	for i := 0; i < len(expected) || i < len(commands); i++ {
+		var e, a string
+		if i < len(expected) {
+			e = expected[i]
+		}
+		if i < len(commands) {
+			a = commands[i]
+		}
+		if e != a {
+			res.Details = append(res.Details, fmt.Sprintf("line %d: expected %q, actual %q", i+1, e, a))
+		}
+	}
+
+	if len(res.Details) != 0 {
+		res.Passed = false
+		res.Message = fmt.Sprintf("commands differ from %s in %d lines", refPath, len(res.Details))
+	}
+	return res
+}
+
+// diffJSON lists the differences between the expected and actual JSON documents,
+// one line per differing path.
+func diffJSON(expected, actual string) ([]string, error) {
+	var e, a interface{}
+	if err := json.Unmarshal([]byte(expected), &e); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(actual), &a); err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	diffValue("", e, a, &changes)
+	return changes, nil
+}
+
+func diffValue(path string, expected, actual interface{}, changes *[]string) {
+	show := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		var keys []string
+		for k := range e {
+			keys = append(keys, k)
+		}
+		for k := range a {
+			if _, ok := e[k]; !ok {
+				keys = append(keys, k)
 			}
-		},
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			ev, eok := e[k]
+			av, aok := a[k]
+			switch {
+			case !aok:
+				*changes = append(*changes, fmt.Sprintf("- %s.%s: %s", path, k, show(ev)))
+			case !eok:
+				*changes = append(*changes, fmt.Sprintf("+ %s.%s: %s", path, k, show(av)))
+			default:
+				diffValue(path+"."+k, ev, av, changes)
+			}
+		}
+		return
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok {
+			break
+		}
+
+		for i := 0; i < len(e) || i < len(a); i++ {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(a):
+				*changes = append(*changes, fmt.Sprintf("- %s: %s", p, show(e[i])))
+			case i >= len(e):
+				*changes = append(*changes, fmt.Sprintf("+ %s: %s", p, show(a[i])))
+			default:
+				diffValue(p, e[i], a[i], changes)
+			}
+		}
+		return
 	}
-)
+
+	if show(expected) != show(actual) {
+		*changes = append(*changes, fmt.Sprintf("~ %s: expected %s, got %s", path, show(expected), show(actual)))
+	}
+}
 
 func init() {
 	rootCmd.AddCommand(testCmd)
@@ -180,4 +445,9 @@ func init() {
 	testCmd.MarkFlagRequired("path")
 
 	testCmd.Flags().StringVarP(&test, "test", "t", "", "target test")
+	testCmd.Flags().BoolVar(&live, "live", false, "create each dataset for real and evaluate its expectations")
+	testCmd.Flags().DurationVar(&liveTimeout, "timeout", time.Second, "timeout of each expectation in live mode")
+	testCmd.Flags().BoolVar(&update, "update", false, "rewrite state.json and commands.txt of datasets with the result")
+	testCmd.Flags().StringVar(&junitPath, "junit", "", "write a JUnit XML report to the path")
+	testCmd.Flags().StringVar(&jsonPath, "json", "", "write a JSON report to the path")
 }
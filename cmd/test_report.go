@@ -0,0 +1,111 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+type testResult struct {
+	Name     string   `json:"name"`
+	Passed   bool     `json:"passed"`
+	Duration float64  `json:"duration_seconds"`
+	Message  string   `json:"message,omitempty"`
+	Details  []string `json:"details,omitempty"`
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Content string `xml:",chardata"`
+}
+
+func writeReports(results []*testResult) error {
+	if jsonPath != "" {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(jsonPath, b, 0644); err != nil {
+			return fmt.Errorf("failed to write JSON report: %s", err)
+		}
+	}
+
+	if junitPath != "" {
+		b, err := junitReport(results)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(junitPath, b, 0644); err != nil {
+			return fmt.Errorf("failed to write JUnit report: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func junitReport(results []*testResult) ([]byte, error) {
+	suite := junitTestSuite{Name: "ayame"}
+
+	total := 0.0
+	for _, res := range results {
+		tc := junitTestCase{
+			Name:      res.Name,
+			ClassName: "ayame",
+			Time:      fmt.Sprintf("%.3f", res.Duration),
+		}
+		if !res.Passed {
+			suite.Failures++
+			tc.Failure = &junitFailure{
+				Message: res.Message,
+				Content: strings.Join(res.Details, "\n"),
+			}
+		}
+
+		total += res.Duration
+		suite.Cases = append(suite.Cases, tc)
+	}
+	suite.Tests = len(results)
+	suite.Time = fmt.Sprintf("%.3f", total)
+
+	b, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), b...), nil
+}
@@ -16,6 +16,10 @@ package config
 
 import (
 	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -25,12 +29,100 @@ type NamespaceDeviceConfig struct {
 	Cidr string `yaml:"cidr"`
 }
 
+type CommandConfig struct {
+	Command string `yaml:"command" json:"command"`
+	// Shell runs the command with `sh -c` so that pipes, redirects and
+	// other shell syntax are available.
+	Shell bool `yaml:"shell" json:"shell,omitempty"`
+	// IgnoreErrors keeps the creation going even if the command failed.
+	IgnoreErrors bool          `yaml:"ignore_errors" json:"ignore_errors,omitempty"`
+	Timeout      time.Duration `yaml:"timeout" json:"timeout,omitempty"`
+	Retries      int           `yaml:"retries" json:"retries,omitempty"`
+	ExpectExit   int           `yaml:"expect_exit" json:"expect_exit,omitempty"`
+}
+
+// UnmarshalYAML accepts both the plain string form and the mapping form.
+func (c *CommandConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var command string
+	if err := unmarshal(&command); err == nil {
+		c.Command = command
+		return nil
+	}
+
+	type plain CommandConfig
+	return unmarshal((*plain)(c))
+}
+
+type RestartPolicy string
+
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// ServiceConfig is a long-running process started detached inside the namespace.
+type ServiceConfig struct {
+	Name    string        `yaml:"name"`
+	Command string        `yaml:"command"`
+	Shell   bool          `yaml:"shell"`
+	Restart RestartPolicy `yaml:"restart"`
+}
+
+// RouteConfig is a route added inside the namespace. Device is the name of the link,
+// and it can be omitted if Via is reachable.
+type RouteConfig struct {
+	To     string `yaml:"to" json:"to"`
+	Via    string `yaml:"via" json:"via,omitempty"`
+	Device string `yaml:"device" json:"device,omitempty"`
+}
+
+func (r RouteConfig) String() string {
+	s := r.To
+	if r.Via != "" {
+		s += " via " + r.Via
+	}
+	if r.Device != "" {
+		s += " dev " + r.Device
+	}
+	return s
+}
+
+// ProbeConfig checks the readiness of the namespace. Only one of TCP, Command and File
+// must be set. TCP and Command run inside the namespace, and File is checked on the host.
+type ProbeConfig struct {
+	TCP     string `yaml:"tcp" json:"tcp,omitempty"`
+	Command string `yaml:"command" json:"command,omitempty"`
+	File    string `yaml:"file" json:"file,omitempty"`
+	// Timeout is 30s by default.
+	Timeout time.Duration `yaml:"timeout" json:"timeout,omitempty"`
+	// AttemptTimeout limits each dial or run of the command, 1s by default.
+	AttemptTimeout time.Duration `yaml:"attempt_timeout" json:"attempt_timeout,omitempty"`
+}
+
 type NamespaceConfig struct {
 	Name     string                  `yaml:"name"`
 	Devices  []NamespaceDeviceConfig `yaml:"devices"`
-	Commands []string                `yaml:"commands"`
+	Commands []CommandConfig         `yaml:"commands"`
+	// Routes are added after commands, so that devices can be set up in commands.
+	Routes []RouteConfig `yaml:"routes"`
+	// OnDelete commands run inside the namespace before it is deleted.
+	OnDelete []CommandConfig `yaml:"on_delete"`
+	Services []ServiceConfig `yaml:"services"`
+	// DependsOn namespaces must be ready before this namespace runs commands and services.
+	DependsOn []string      `yaml:"depends_on"`
+	ReadyWhen []ProbeConfig `yaml:"ready_when"`
 }
 
+type CommandFailurePolicy string
+
+const (
+	// PolicyAbort rolls back the creation when a command failed.
+	PolicyAbort = "abort"
+	// PolicyContinue only logs failed commands, and runs the rest of them.
+	PolicyContinue = "continue"
+)
+
 type LinkMode string
 
 const (
@@ -43,9 +135,74 @@ type LinkConfig struct {
 	Name     string   `yaml:"name"`
 }
 
+const (
+	ProtocolICMP = "icmp"
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+)
+
+// ExpectConfig declares that the namespace From can or cannot reach the namespace To
+// or the Address. Protocol is icmp without Port, and tcp with Port by default.
+type ExpectConfig struct {
+	From      string `yaml:"from" json:"from"`
+	To        string `yaml:"to" json:"to,omitempty"`
+	Address   string `yaml:"address" json:"address,omitempty"`
+	Protocol  string `yaml:"protocol" json:"protocol"`
+	Port      int    `yaml:"port" json:"port,omitempty"`
+	Reachable *bool  `yaml:"reachable" json:"reachable,omitempty"`
+}
+
+// ApplyDefaults fills the protocol by the port.
+func (e *ExpectConfig) ApplyDefaults() {
+	if e.Protocol != "" {
+		return
+	}
+	if e.Port == 0 {
+		e.Protocol = ProtocolICMP
+	} else {
+		e.Protocol = ProtocolTCP
+	}
+}
+
+// ShouldReach is true unless reachable: false is set.
+func (e *ExpectConfig) ShouldReach() bool {
+	return e.Reachable == nil || *e.Reachable
+}
+
+func (e *ExpectConfig) String() string {
+	target := e.To
+	if target == "" {
+		target = e.Address
+	}
+	if e.Port != 0 {
+		target = fmt.Sprintf("%s %s/%d", target, e.Protocol, e.Port)
+	} else {
+		target = fmt.Sprintf("%s %s", target, e.Protocol)
+	}
+
+	if e.ShouldReach() {
+		return fmt.Sprintf("%s can reach %s", e.From, target)
+	}
+	return fmt.Sprintf("%s cannot reach %s", e.From, target)
+}
+
+// HooksConfig is the lab-level commands which run on the host.
+// These are saved in the state so that they can run on deletion without the config.
+type HooksConfig struct {
+	PreCreate  []CommandConfig `yaml:"pre_create" json:"pre_create,omitempty"`
+	PostCreate []CommandConfig `yaml:"post_create" json:"post_create,omitempty"`
+	PreDelete  []CommandConfig `yaml:"pre_delete" json:"pre_delete,omitempty"`
+	PostDelete []CommandConfig `yaml:"post_delete" json:"post_delete,omitempty"`
+}
+
 type Config struct {
-	Links      []*LinkConfig      `yaml:"links"`
-	Namespaces []*NamespaceConfig `yaml:"namespaces"`
+	// Name is the name of the lab. The file name of the config is used by default.
+	Name                 string               `yaml:"name"`
+	Links                []*LinkConfig        `yaml:"links"`
+	Namespaces           []*NamespaceConfig   `yaml:"namespaces"`
+	CommandFailurePolicy CommandFailurePolicy `yaml:"command_failure_policy"`
+	Hooks                HooksConfig          `yaml:"hooks"`
+	Expect               []ExpectConfig       `yaml:"expect"`
 }
 
 func ParseConfig(bytes []byte) (*Config, error) {
@@ -54,12 +211,54 @@ func ParseConfig(bytes []byte) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config: %s", err)
 	}
 
+	if cfg.CommandFailurePolicy == "" {
+		cfg.CommandFailurePolicy = PolicyAbort
+	}
+
+	for i := range cfg.Expect {
+		cfg.Expect[i].ApplyDefaults()
+	}
+
+	if cfg.Name != "" {
+		if err := ValidateLabName(cfg.Name); err != nil {
+			return nil, err
+		}
+	}
+	if err := ValidateCommandFailurePolicy(cfg.CommandFailurePolicy); err != nil {
+		return nil, err
+	}
 	if err := ValidateLinkConfigs(cfg.Links); err != nil {
 		return nil, err
 	}
 	if err := ValidateNamespace(cfg.Namespaces, cfg.Links); err != nil {
 		return nil, err
 	}
+	if err := ValidateHooks(&cfg.Hooks); err != nil {
+		return nil, err
+	}
+	if err := ValidateExpectations(cfg.Expect, cfg.Namespaces); err != nil {
+		return nil, err
+	}
 
 	return &cfg, nil
 }
+
+// LabName returns the name of the lab created from the config at the path. Without the name
+// in the config, it is the file name followed by the hash of the absolute path, since configs
+// in different directories often have the same file name, e.g. config.yaml.
+func LabName(cfg *Config, path string) string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	h := fnv.New32a()
+	h.Write([]byte(abs))
+
+	base := filepath.Base(path)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	return fmt.Sprintf("%s-%08x", invalidLabNameChars.ReplaceAllString(base, "-"), h.Sum32())
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "fmt"
+
+// StartupOrder sorts the namespaces so that each namespace comes after all of
+// its depends_on. Namespaces without dependencies between them keep the order in
+// the config.
+func StartupOrder(configs []*NamespaceConfig) ([]*NamespaceConfig, error) {
+	byName := make(map[string]*NamespaceConfig)
+	for _, cfg := range configs {
+		byName[cfg.Name] = cfg
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make(map[string]int)
+
+	var order []*NamespaceConfig
+	var visit func(cfg *NamespaceConfig, path []string) error
+	visit = func(cfg *NamespaceConfig, path []string) error {
+		switch marks[cfg.Name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle found: %v", append(path, cfg.Name))
+		case visited:
+			return nil
+		}
+
+		marks[cfg.Name] = visiting
+		for _, dep := range cfg.DependsOn {
+			depCfg, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("namespace %s depends on unknown namespace %s", cfg.Name, dep)
+			}
+			if err := visit(depCfg, append(path, cfg.Name)); err != nil {
+				return err
+			}
+		}
+		marks[cfg.Name] = visited
+
+		order = append(order, cfg)
+		return nil
+	}
+
+	for _, cfg := range configs {
+		if err := visit(cfg, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
@@ -1,6 +1,24 @@
 package config
 
-import "fmt"
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+var (
+	labNamePattern      = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+	invalidLabNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+)
+
+// ValidateLabName checks that the name can be used in paths and names of network namespaces.
+func ValidateLabName(name string) error {
+	if !labNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid lab name %s: it must consist of alphanumerics, - and _", name)
+	}
+	return nil
+}
 
 func ValidateLinkConfigs(linkConfigs []*LinkConfig) error {
 	// Check required fields
@@ -54,5 +72,203 @@ func ValidateNamespace(configs []*NamespaceConfig, linkConfigs []*LinkConfig) er
 		}
 	}
 
+	for _, cfg := range configs {
+		if err := validateCommands(cfg.Commands, "namespace "+cfg.Name); err != nil {
+			return err
+		}
+		if err := validateCommands(cfg.OnDelete, "namespace "+cfg.Name); err != nil {
+			return err
+		}
+		if err := validateServices(cfg.Services, cfg.Name); err != nil {
+			return err
+		}
+		if err := validateRoutes(cfg); err != nil {
+			return err
+		}
+		if err := validateProbes(cfg.ReadyWhen, cfg.Name); err != nil {
+			return err
+		}
+	}
+
+	if _, err := StartupOrder(configs); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func ValidateCommandFailurePolicy(policy CommandFailurePolicy) error {
+	if policy != PolicyAbort && policy != PolicyContinue {
+		return fmt.Errorf("unknown command failure policy %s", policy)
+	}
+	return nil
+}
+
+func ValidateHooks(hooks *HooksConfig) error {
+	if err := validateCommands(hooks.PreCreate, "pre_create"); err != nil {
+		return err
+	}
+	if err := validateCommands(hooks.PostCreate, "post_create"); err != nil {
+		return err
+	}
+	if err := validateCommands(hooks.PreDelete, "pre_delete"); err != nil {
+		return err
+	}
+	if err := validateCommands(hooks.PostDelete, "post_delete"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func validateCommands(commands []CommandConfig, where string) error {
+	for _, command := range commands {
+		if strings.TrimSpace(command.Command) == "" {
+			return fmt.Errorf("command must not be empty in %s", where)
+		}
+		if command.Retries < 0 {
+			return fmt.Errorf("retries must not be negative: %s", command.Command)
+		}
+		if command.Timeout < 0 {
+			return fmt.Errorf("timeout must not be negative: %s", command.Command)
+		}
+	}
+	return nil
+}
+
+func validateServices(services []ServiceConfig, nsName string) error {
+	names := make(map[string]bool)
+	for _, svc := range services {
+		if svc.Name == "" {
+			return fmt.Errorf("service name must not be empty in namespace %s", nsName)
+		}
+		if _, ok := names[svc.Name]; ok {
+			return fmt.Errorf("service name must be unique in namespace %s", nsName)
+		}
+		names[svc.Name] = false
+
+		if strings.TrimSpace(svc.Command) == "" {
+			return fmt.Errorf("command of service %s must not be empty", svc.Name)
+		}
+
+		switch svc.Restart {
+		case "", RestartNever, RestartOnFailure, RestartAlways:
+		default:
+			return fmt.Errorf("unknown restart policy %s of service %s", svc.Restart, svc.Name)
+		}
+	}
+	return nil
+}
+
+func validateProbes(probes []ProbeConfig, nsName string) error {
+	for _, probe := range probes {
+		if err := ValidateProbe(&probe); err != nil {
+			return fmt.Errorf("ready_when of namespace %s: %s", nsName, err)
+		}
+	}
+	return nil
+}
+
+func ValidateProbe(probe *ProbeConfig) error {
+	count := 0
+	for _, p := range []string{probe.TCP, probe.Command, probe.File} {
+		if p != "" {
+			count++
+		}
+	}
+	if count != 1 {
+		return fmt.Errorf("probe must have only one of tcp, command and file")
+	}
+
+	if probe.Timeout < 0 {
+		return fmt.Errorf("timeout of probe must not be negative")
+	}
+	if probe.AttemptTimeout < 0 {
+		return fmt.Errorf("attempt_timeout of probe must not be negative")
+	}
+	return nil
+}
+
+func ValidateExpectations(expects []ExpectConfig, configs []*NamespaceConfig) error {
+	nsExists := func(name string) bool {
+		for _, cfg := range configs {
+			if cfg.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, e := range expects {
+		if !nsExists(e.From) {
+			return fmt.Errorf("unknown namespace %s in expect", e.From)
+		}
+
+		if e.To != "" && !nsExists(e.To) {
+			return fmt.Errorf("unknown namespace %s in expect", e.To)
+		}
+		if err := ValidateExpectation(&e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateExpectation checks the fields of the expectation which don't depend on namespaces.
+func ValidateExpectation(e *ExpectConfig) error {
+	if e.From == "" {
+		return fmt.Errorf("from must not be empty in expect")
+	}
+	if (e.To == "") == (e.Address == "") {
+		return fmt.Errorf("expect from %s must have only one of to and address", e.From)
+	}
+	if e.To == e.From {
+		return fmt.Errorf("expect from %s must not point to itself", e.From)
+	}
+	if e.Address != "" && net.ParseIP(e.Address) == nil {
+		return fmt.Errorf("invalid address %s in expect", e.Address)
+	}
+
+	switch e.Protocol {
+	case ProtocolICMP:
+		if e.Port != 0 {
+			return fmt.Errorf("port must not be set with icmp in expect from %s", e.From)
+		}
+	case ProtocolTCP, ProtocolUDP:
+		if e.Port <= 0 || e.Port > 65535 {
+			return fmt.Errorf("invalid port %d in expect from %s", e.Port, e.From)
+		}
+	default:
+		return fmt.Errorf("unknown protocol %s in expect from %s", e.Protocol, e.From)
+	}
+	return nil
+}
+
+func validateRoutes(cfg *NamespaceConfig) error {
+	for _, route := range cfg.Routes {
+		if route.To != "default" {
+			if _, _, err := net.ParseCIDR(route.To); err != nil {
+				return fmt.Errorf("invalid route destination %s in namespace %s", route.To, cfg.Name)
+			}
+		}
+
+		if route.Via == "" && route.Device == "" {
+			return fmt.Errorf("route %s in namespace %s must have via or device", route.To, cfg.Name)
+		}
+		if route.Via != "" && net.ParseIP(route.Via) == nil {
+			return fmt.Errorf("invalid route gateway %s in namespace %s", route.Via, cfg.Name)
+		}
+
+		if route.Device != "" {
+			found := false
+			for _, dev := range cfg.Devices {
+				if dev.Name == route.Device {
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("route %s in namespace %s uses unconfigured device %s", route.To, cfg.Name, route.Device)
+			}
+		}
+	}
 	return nil
 }
@@ -0,0 +1,394 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Statuses of checks.
+const (
+	StatusOK   = "ok"
+	StatusWarn = "warn"
+	StatusFail = "fail"
+)
+
+const ovsdbTimeout = 3 * time.Second
+
+// Check is the result of a check of the environment.
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	// Fix tells how to fix the problem if the check didn't pass.
+	Fix string `json:"fix,omitempty"`
+}
+
+// Failed reports whether any of the checks failed.
+func Failed(checks []Check) bool {
+	for _, c := range checks {
+		if c.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+// requirements are what the lab needs. Everything is checked without a config,
+// but only iproute2 and veth are required then. iproute2 isn't required by the netlink backend.
+type requirements struct {
+	iproute2 bool
+	veth     bool
+	ovs      bool
+}
+
+func requirementsOf(ctx context.Context, cfg *config.Config) requirements {
+	iproute2 := network.BackendName(ctx) == network.BackendIproute2
+	if cfg == nil {
+		return requirements{iproute2: iproute2, veth: true}
+	}
+
+	r := requirements{iproute2: iproute2}
+	for _, link := range cfg.Links {
+		switch link.LinkMode {
+		case config.ModeDirectLink:
+			r.veth = true
+		case config.ModeBridge:
+			// Namespaces are linked to bridges with veths.
+			r.veth = true
+			r.ovs = true
+		}
+	}
+	return r
+}
+
+// Run checks the environment for the lab of the config. cfg can be nil to check the host only.
+func Run(ctx context.Context, cfg *config.Config, lab string) []Check {
+	req := requirementsOf(ctx, cfg)
+
+	checks := []Check{
+		checkPrivileges(),
+	}
+	checks = append(checks, optional([]Check{checkIproute2(ctx)}, req.iproute2, "needed only for the iproute2 backend")...)
+
+	if cfg == nil || req.ovs {
+		ovs := []Check{checkOvsVsctl(ctx)}
+		if ovs[0].Status == StatusOK {
+			ovs = append(ovs, checkOvsdb(ctx))
+		}
+		checks = append(checks, optional(ovs, req.ovs, "needed only for bridges")...)
+	}
+
+	if req.veth {
+		checks = append(checks, checkModule("veth"))
+	}
+	if cfg == nil || req.ovs {
+		checks = append(checks, optional([]Check{checkModule("openvswitch")}, req.ovs, "needed only for bridges")...)
+	}
+
+	if cfg != nil {
+		checks = append(checks, checkNames(ctx, cfg, lab)...)
+	}
+
+	return checks
+}
+
+// optional turns failures into warnings with the reason unless they are required.
+func optional(checks []Check, required bool, reason string) []Check {
+	if required {
+		return checks
+	}
+	for i := range checks {
+		if checks[i].Status == StatusFail {
+			checks[i].Status = StatusWarn
+			checks[i].Detail += " (" + reason + ")"
+		}
+	}
+	return checks
+}
+
+// Capabilities in CapEff of /proc/self/status.
+const (
+	capNetAdmin = 12
+	capSysAdmin = 21
+)
+
+func checkPrivileges() Check {
+	c := Check{Name: "privileges"}
+
+	b, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		c.Status, c.Detail = StatusWarn, fmt.Sprintf("failed to read capabilities: %s", err)
+		return c
+	}
+
+	var caps uint64
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "CapEff:") {
+			caps, _ = strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		}
+	}
+
+	var missing []string
+	if caps&(1<<capNetAdmin) == 0 {
+		missing = append(missing, "CAP_NET_ADMIN")
+	}
+	if caps&(1<<capSysAdmin) == 0 {
+		missing = append(missing, "CAP_SYS_ADMIN")
+	}
+
+	if len(missing) != 0 {
+		c.Status = StatusFail
+		c.Detail = fmt.Sprintf("running as uid %d without %s", os.Geteuid(), strings.Join(missing, " and "))
+		c.Fix = "run ayame with sudo"
+		return c
+	}
+
+	c.Status = StatusOK
+	c.Detail = fmt.Sprintf("running as uid %d with CAP_NET_ADMIN and CAP_SYS_ADMIN", os.Geteuid())
+	return c
+}
+
+// version runs the command and returns the first match of the pattern in its output.
+func version(ctx context.Context, pattern *regexp.Regexp, name string, args ...string) (string, error) {
+	var out bytes.Buffer
+	if err := network.ExecutorFrom(ctx).Run(ctx, &network.Command{Name: name, Args: args, Stdout: &out}); err != nil {
+		return "", err
+	}
+
+	m := pattern.FindStringSubmatch(out.String())
+	if m == nil {
+		return "unknown version", nil
+	}
+	return m[1], nil
+}
+
+var (
+	iproute2Version = regexp.MustCompile(`iproute2-(\S+?),?\s`)
+	ovsVersion      = regexp.MustCompile(`\(Open vSwitch\) (\S+)`)
+)
+
+func checkIproute2(ctx context.Context) Check {
+	c := Check{Name: "iproute2"}
+
+	path, err := exec.LookPath("ip")
+	if err != nil {
+		c.Status, c.Detail = StatusFail, "ip is not found in PATH"
+		c.Fix = "install iproute2, e.g. `apt install iproute2` or `dnf install iproute`"
+		return c
+	}
+
+	v, err := version(ctx, iproute2Version, "ip", "-V")
+	if err != nil {
+		c.Status, c.Detail = StatusFail, fmt.Sprintf("failed to run %s -V: %s", path, err)
+		c.Fix = "reinstall iproute2"
+		return c
+	}
+
+	c.Status, c.Detail = StatusOK, fmt.Sprintf("%s %s", path, v)
+	return c
+}
+
+func checkOvsVsctl(ctx context.Context) Check {
+	c := Check{Name: "ovs-vsctl"}
+
+	path, err := exec.LookPath("ovs-vsctl")
+	if err != nil {
+		c.Status, c.Detail = StatusFail, "ovs-vsctl is not found in PATH"
+		c.Fix = "install Open vSwitch, e.g. `apt install openvswitch-switch` or `dnf install openvswitch`"
+		return c
+	}
+
+	v, err := version(ctx, ovsVersion, "ovs-vsctl", "--version")
+	if err != nil {
+		c.Status, c.Detail = StatusFail, fmt.Sprintf("failed to run %s --version: %s", path, err)
+		c.Fix = "reinstall Open vSwitch"
+		return c
+	}
+
+	c.Status, c.Detail = StatusOK, fmt.Sprintf("%s %s", path, v)
+	return c
+}
+
+func checkOvsdb(ctx context.Context) Check {
+	c := Check{Name: "ovsdb"}
+
+	ctx, cancel := context.WithTimeout(ctx, ovsdbTimeout)
+	defer cancel()
+
+	timeout := fmt.Sprintf("--timeout=%d", int(ovsdbTimeout.Seconds()))
+	if err := network.ExecutorFrom(ctx).Run(ctx, &network.Command{Name: "ovs-vsctl", Args: []string{timeout, "show"}}); err != nil {
+		c.Status, c.Detail = StatusFail, fmt.Sprintf("failed to connect to ovsdb: %s", err)
+		c.Fix = "start Open vSwitch, e.g. `systemctl start openvswitch-switch` or `systemctl start openvswitch`"
+		return c
+	}
+
+	c.Status, c.Detail = StatusOK, "ovsdb-server is reachable"
+	return c
+}
+
+func checkModule(name string) Check {
+	c := Check{Name: "kernel module " + name}
+
+	if _, err := os.Stat(filepath.Join("/sys/module", name)); err == nil {
+		c.Status, c.Detail = StatusOK, "loaded"
+		return c
+	}
+
+	var uts unix.Utsname
+	unix.Uname(&uts)
+	release := unix.ByteSliceToString(uts.Release[:])
+	dir := filepath.Join("/lib/modules", release)
+
+	if _, err := os.Stat(dir); err != nil {
+		c.Status = StatusWarn
+		c.Detail = fmt.Sprintf("not loaded, and modules of kernel %s are not found. it may be built in", release)
+		return c
+	}
+
+	// Names in the lists are paths like kernel/drivers/net/veth.ko.xz.
+	pattern := regexp.MustCompile(`(^|/)` + regexp.QuoteMeta(name) + `\.ko(\.\w+)?:?(\s|$)`)
+	for _, list := range []string{"modules.builtin", "modules.dep"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, list))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if !pattern.MatchString(line) {
+				continue
+			}
+			if list == "modules.builtin" {
+				c.Status, c.Detail = StatusOK, "built in"
+			} else {
+				c.Status, c.Detail = StatusOK, "not loaded, but loaded on demand"
+			}
+			return c
+		}
+	}
+
+	c.Status = StatusFail
+	c.Detail = fmt.Sprintf("not found for kernel %s", release)
+	c.Fix = fmt.Sprintf("install the modules of kernel %s, e.g. `apt install linux-modules-extra-%s`, then `modprobe %s`",
+		release, release, name)
+	return c
+}
+
+// plannedNames returns the namespaces and the host interfaces created for the lab,
+// recorded from a dry run.
+func plannedNames(cfg *config.Config, lab string) ([]string, []string, error) {
+	// The dry run is an implementation detail of the check.
+	level := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(level)
+
+	executor := &network.DryRunExecutor{}
+	ctx := network.WithExecutor(context.Background(), executor)
+	if _, err := state.InitResources(ctx, cfg, lab); err != nil {
+		return nil, nil, err
+	}
+
+	var netns, ifnames []string
+	for _, cmd := range executor.Commands() {
+		a := cmd.Args
+		switch {
+		case cmd.Name == "ip" && len(a) == 3 && a[0] == "netns" && a[1] == "add":
+			netns = append(netns, a[2])
+		case cmd.Name == "ip" && len(a) == 8 && a[0] == "link" && a[1] == "add" && a[4] == "type" && a[5] == "veth":
+			ifnames = append(ifnames, a[3], a[7])
+		case cmd.Name == "ovs-vsctl" && len(a) >= 2 && a[0] == "add-br":
+			// The bridge has an internal interface of the same name.
+			ifnames = append(ifnames, a[1])
+		}
+	}
+	return netns, ifnames, nil
+}
+
+func checkNames(ctx context.Context, cfg *config.Config, lab string) []Check {
+	c := Check{Name: "lab " + lab}
+
+	if state.ResourcesSaved(lab) || state.Interrupted(lab) {
+		c.Status, c.Detail = StatusFail, fmt.Sprintf("lab %s has already been created", lab)
+		c.Fix = fmt.Sprintf("run `ayame delete --lab %s`, or create another lab with --lab", lab)
+		return []Check{c}
+	}
+
+	netns, ifnames, err := plannedNames(cfg, lab)
+	if err != nil {
+		c.Status, c.Detail = StatusFail, err.Error()
+		c.Fix = "fix the config"
+		return []Check{c}
+	}
+	c.Status, c.Detail = StatusOK, fmt.Sprintf("%d namespaces and %d interfaces to be created", len(netns), len(ifnames))
+	checks := []Check{c}
+
+	existingNetns := network.ListNetns(ctx)
+	var collided []string
+	for _, ns := range netns {
+		if existingNetns[ns] {
+			collided = append(collided, ns)
+		}
+	}
+	checks = append(checks, collision("netns names", collided, "namespaces",
+		"delete them with `ip netns delete`, `ayame gc` if ayame left them, or use another lab name"))
+
+	existingIfs := make(map[string]bool)
+	if ifs, err := net.Interfaces(); err == nil {
+		for _, i := range ifs {
+			existingIfs[i.Name] = true
+		}
+	}
+	collided = nil
+	for _, name := range ifnames {
+		if existingIfs[name] {
+			collided = append(collided, name)
+		}
+	}
+	checks = append(checks, collision("interface names", collided, "interfaces",
+		"delete them with `ip link delete`, `ayame gc` if ayame left them, or use another lab name"))
+
+	return checks
+}
+
+func collision(name string, collided []string, kind string, fix string) Check {
+	if len(collided) == 0 {
+		return Check{Name: name, Status: StatusOK, Detail: fmt.Sprintf("no %s collide", kind)}
+	}
+
+	sort.Strings(collided)
+	return Check{
+		Name:   name,
+		Status: StatusFail,
+		Detail: fmt.Sprintf("%s already exist: %s", kind, strings.Join(collided, ", ")),
+		Fix:    fix,
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
+)
+
+// FormatShell renders the lab as bash scripts.
+const FormatShell = "sh"
+
+// steps collects the steps of the dry run, which are undone by the teardown script.
+type steps struct {
+	steps []network.Step
+}
+
+func (s *steps) Record(step network.Step) error {
+	s.steps = append(s.steps, step)
+	return nil
+}
+
+func (s *steps) Discard(step network.Step) error {
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		if s.steps[i].String() == step.String() {
+			s.steps = append(s.steps[:i], s.steps[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Scripts renders the operations of creating the lab from the config as a bash script,
+// and their undo as a teardown script. Both scripts skip what has been done already,
+// so they can be run again.
+func Scripts(cfg *config.Config, lab string) (string, string, error) {
+	created := &network.DryRunExecutor{}
+	rec := &steps{}
+	ctx := network.WithRecorder(network.WithExecutor(context.Background(), created), rec)
+
+	s, err := state.InitResources(ctx, cfg, lab)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Teardown follows the order of `ayame delete`.
+	preDelete := &network.DryRunExecutor{}
+	network.RunHostCommands(network.WithExecutor(context.Background(), preDelete), s.Hooks.PreDelete, config.PolicyContinue)
+
+	onDelete := &network.DryRunExecutor{}
+	network.RunNamespacesOnDeleteCommands(network.WithExecutor(context.Background(), onDelete), s.Namespaces)
+
+	undo := &network.DryRunExecutor{}
+	for i := len(rec.steps) - 1; i >= 0; i-- {
+		if err := network.UndoStep(network.WithExecutor(context.Background(), undo), rec.steps[i]); err != nil {
+			return "", "", err
+		}
+	}
+
+	postDelete := &network.DryRunExecutor{}
+	network.RunHostCommands(network.WithExecutor(context.Background(), postDelete), s.Hooks.PostDelete, config.PolicyContinue)
+
+	c := newScript(lab, "creates", createHelpers)
+	services := c.create(created.Commands(), cfg.CommandFailurePolicy)
+
+	t := newScript(lab, "deletes", teardownHelpers)
+	t.hostCommands(preDelete.Commands())
+	t.namespaceCommands(onDelete.Commands())
+	for i := len(services) - 1; i >= 0; i-- {
+		t.line("stop_service %s", network.ShellQuote(services[i]))
+	}
+	t.undo(undo.Commands())
+	t.hostCommands(postDelete.Commands())
+
+	return c.String(), t.String(), nil
+}
+
+const header = `#!/usr/bin/env bash
+# Generated by ayame export. It %s lab %s, and skips what has been done already.
+set -euo pipefail
+
+LOG_DIR="${LOG_DIR:-/var/log/ayame/%s}"
+RUN_DIR="${RUN_DIR:-/run/ayame/%s}"
+
+netns_exists() { [ -e "/var/run/netns/$1" ]; }
+on_host() { ip link show dev "$1" >/dev/null 2>&1; }
+in_netns() { netns_exists "$1" && ip -n "$1" link show dev "$2" >/dev/null 2>&1; }
+has_addr() { in_netns "$1" "$2" && [[ "$(ip -n "$1" -o addr show dev "$2")" == *" $3 "* ]]; }
+warn() { echo "warning: $*" >&2; }
+
+# link_exists IFNAME: the device is on the host or in any namespace.
+link_exists() {
+	on_host "$1" && return 0
+	for ns in /var/run/netns/*; do
+		[ -e "$ns" ] || continue
+		in_netns "$(basename "$ns")" "$1" && return 0
+	done
+	return 1
+}
+
+`
+
+const createHelpers = `# start_service NAME RESTART COMMAND...: starts the command in its own session unless it is running,
+# and restarts it by following the policy. Outputs go to $LOG_DIR/NAME.log.
+start_service() {
+	local name=$1 restart=$2
+	shift 2
+	local pidfile="$RUN_DIR/$name.pid"
+	if [ -f "$pidfile" ] && kill -0 "$(cat "$pidfile")" 2>/dev/null; then
+		return 0
+	fi
+	mkdir -p "$LOG_DIR" "$RUN_DIR"
+	setsid bash -c 'restart=$1; shift
+		while :; do
+			"$@" && code=0 || code=$?
+			if [ "$restart" != always ] && { [ "$restart" != on-failure ] || [ "$code" -eq 0 ]; }; then
+				break
+			fi
+			sleep 1
+		done' service "$restart" "$@" >>"$LOG_DIR/$name.log" 2>&1 </dev/null &
+	echo $! >"$pidfile"
+}
+
+declare -A created=()
+`
+
+const teardownHelpers = `# stop_service NAME: stops the session of the service.
+stop_service() {
+	local pidfile="$RUN_DIR/$1.pid"
+	[ -f "$pidfile" ] || return 0
+	kill -TERM -- "-$(cat "$pidfile")" 2>/dev/null || true
+	rm -f "$pidfile"
+}
+`
+
+type script struct {
+	b strings.Builder
+}
+
+func newScript(lab string, action string, helpers string) *script {
+	s := &script{}
+	fmt.Fprintf(&s.b, header, action, lab, lab, lab)
+	s.line("%s", helpers)
+	return s
+}
+
+func (s *script) String() string {
+	return s.b.String()
+}
+
+func (s *script) line(format string, args ...interface{}) {
+	fmt.Fprintf(&s.b, format+"\n", args...)
+}
+
+// match reports whether the command is the name followed by the args. "*" matches any arg,
+// and "..." matches the rest.
+func match(cmd network.RecordedCommand, name string, args ...string) bool {
+	if cmd.Name != name {
+		return false
+	}
+	for i, a := range args {
+		if a == "..." {
+			return true
+		}
+		if i >= len(cmd.Args) || (a != "*" && a != cmd.Args[i]) {
+			return false
+		}
+	}
+	return len(args) == len(cmd.Args)
+}
+
+// create renders the commands of the creation, and returns the names of the services.
+func (s *script) create(cmds []network.RecordedCommand, policy config.CommandFailurePolicy) []string {
+	var services []string
+	for _, cmd := range cmds {
+		line := network.CommandLine(cmd.Name, cmd.Args)
+		a := cmd.Args
+
+		switch {
+		case cmd.Detached:
+			name, restart, args := superviseArgs(cmd.Args)
+			services = append(services, name)
+			s.line("start_service %s %s %s", network.ShellQuote(name), network.ShellQuote(restart), network.CommandLine(args[0], args[1:]))
+		case match(cmd, "ip", "netns", "add", "*"):
+			s.line("if ! netns_exists %s; then", network.ShellQuote(a[2]))
+			s.line("\t%s", line)
+			s.line("\tcreated[%s]=1", network.ShellQuote(a[2]))
+			s.line("fi")
+		case match(cmd, "ip", "link", "add", "name", "*", "type", "veth", "peer", "*"):
+			s.line("link_exists %s || %s", network.ShellQuote(a[3]), line)
+		case match(cmd, "ip", "link", "set", "dev", "*", "alias", "*"):
+			s.line("! on_host %s || %s", network.ShellQuote(a[3]), line)
+		case match(cmd, "ip", "link", "set", "*", "netns", "*"):
+			s.line("! on_host %s || %s", network.ShellQuote(a[2]), line)
+		case match(cmd, "ip", "netns", "exec", "*", "ip", "addr", "add", "*", "dev", "*"):
+			s.line("has_addr %s %s %s || %s", network.ShellQuote(a[2]), network.ShellQuote(a[8]), network.ShellQuote(a[6]), line)
+		case match(cmd, "ip", "netns", "exec", "*", "ip", "route", "add", "..."):
+			args := append(append([]string(nil), a[:5]...), "replace")
+			s.line("%s", network.CommandLine(cmd.Name, append(args, a[6:]...)))
+		case match(cmd, "ovs-vsctl", "add-br", "..."), match(cmd, "ovs-vsctl", "add-port", "..."):
+			s.line("%s", network.CommandLine(cmd.Name, append([]string{"--may-exist"}, a...)))
+		case match(cmd, "ip", "netns", "exec", "*", "..."):
+			// Commands in namespaces run only when the namespace is created by this run.
+			s.line("if [ -n \"${created[%s]:-}\" ]; then", network.ShellQuote(a[2]))
+			s.line("\t%s", withPolicy(line, policy))
+			s.line("fi")
+		default:
+			s.line("%s", withPolicy(line, policy))
+		}
+	}
+	return services
+}
+
+// undo renders the commands undoing the creation.
+func (s *script) undo(cmds []network.RecordedCommand) {
+	for _, cmd := range cmds {
+		line := network.CommandLine(cmd.Name, cmd.Args)
+		a := cmd.Args
+
+		switch {
+		case match(cmd, "ip", "netns", "delete", "*"):
+			s.line("! netns_exists %s || %s", network.ShellQuote(a[2]), line)
+		case match(cmd, "ip", "link", "delete", "*"):
+			s.line("! on_host %s || %s", network.ShellQuote(a[2]), line)
+		case match(cmd, "ip", "netns", "exec", "*", "ip", "link", "delete", "*"):
+			s.line("! in_netns %s %s || %s", network.ShellQuote(a[2]), network.ShellQuote(a[6]), line)
+		case match(cmd, "ip", "netns", "exec", "*", "ip", "addr", "del", "*", "dev", "*"):
+			s.line("! has_addr %s %s %s || %s", network.ShellQuote(a[2]), network.ShellQuote(a[8]), network.ShellQuote(a[6]), line)
+		case match(cmd, "ip", "netns", "exec", "*", "ip", "route", "del", "..."):
+			s.line("! netns_exists %s || %s 2>/dev/null || true", network.ShellQuote(a[2]), line)
+		default:
+			s.line("%s", line)
+		}
+	}
+}
+
+// hostCommands renders the hooks, which don't stop the teardown.
+func (s *script) hostCommands(cmds []network.RecordedCommand) {
+	for _, cmd := range cmds {
+		s.line("%s", withPolicy(network.CommandLine(cmd.Name, cmd.Args), config.PolicyContinue))
+	}
+}
+
+// namespaceCommands renders on_delete commands, which run if the namespace exists.
+func (s *script) namespaceCommands(cmds []network.RecordedCommand) {
+	for _, cmd := range cmds {
+		line := withPolicy(network.CommandLine(cmd.Name, cmd.Args), config.PolicyContinue)
+		if match(cmd, "ip", "netns", "exec", "*", "...") {
+			line = fmt.Sprintf("! netns_exists %s || %s", network.ShellQuote(cmd.Args[2]), line)
+		}
+		s.line("%s", line)
+	}
+}
+
+// superviseArgs returns the name, the restart policy and the command of the service
+// from the arguments of `ayame supervise`.
+func superviseArgs(args []string) (string, string, []string) {
+	var logPath, restart string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--log":
+			i++
+			logPath = args[i]
+		case "--restart":
+			i++
+			restart = args[i]
+		case "--":
+			return strings.TrimSuffix(filepath.Base(logPath), ".log"), restart, args[i+1:]
+		}
+	}
+	return "", restart, nil
+}
+
+func withPolicy(line string, policy config.CommandFailurePolicy) string {
+	if policy != config.PolicyContinue {
+		return line
+	}
+	return fmt.Sprintf("%s || warn %s", line, network.ShellQuote("failed: "+line))
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"context"
+	"fmt"
+)
+
+// Backends which change the network of the host.
+const (
+	BackendIproute2 = "iproute2"
+	BackendNetlink  = "netlink"
+)
+
+// backend performs the operations on namespaces, links, addresses and routes.
+// nsname is empty for the devices on the host.
+type backend interface {
+	addNetns(ctx context.Context, name string) error
+	deleteNetns(ctx context.Context, name string) error
+	netnsExists(ctx context.Context, name string) (bool, error)
+	listNetns(ctx context.Context) (map[string]bool, error)
+	addVeth(ctx context.Context, left string, right string) error
+	setAlias(ctx context.Context, ifname string, alias string) error
+	deleteLink(ctx context.Context, ifname string, nsname string) error
+	linkExists(ctx context.Context, ifname string, nsname string) (bool, error)
+	setNetns(ctx context.Context, ifname string, nsname string) error
+	setHostNetns(ctx context.Context, ifname string, nsname string) error
+	setLinkState(ctx context.Context, ifname string, nsname string, up bool) error
+	addAddr(ctx context.Context, ifname string, nsname string, cidr string) error
+	deleteAddr(ctx context.Context, ifname string, nsname string, cidr string) error
+	route(ctx context.Context, op string, nsname string, to string, via string, ifname string) error
+	listLinks(ctx context.Context, nsname string) (map[string]LinkInfo, error)
+	listRoutes(ctx context.Context, nsname string) ([]RouteInfo, error)
+	setNetem(ctx context.Context, ifname string, nsname string, args []string) error
+	// execArgs returns the command which runs args inside the namespace.
+	execArgs(nsname string, args []string) ([]string, error)
+}
+
+// WithBackend returns the context whose changes are made by the backend of the name.
+func WithBackend(ctx context.Context, name string) (context.Context, error) {
+	switch name {
+	case BackendIproute2, BackendNetlink:
+	default:
+		return nil, fmt.Errorf("unknown backend %s, expected %s or %s", name, BackendIproute2, BackendNetlink)
+	}
+	return withSettings(ctx, func(s *settings) { s.backend = name }), nil
+}
+
+// BackendName returns the name of the backend selected for ctx.
+func BackendName(ctx context.Context) string {
+	return settingsFrom(ctx).backend
+}
+
+// backendFor returns the backend for ctx. Commands of iproute2 are used unless they are
+// executed on the host, so that they can be recorded.
+func backendFor(ctx context.Context) backend {
+	if _, ok := ExecutorFrom(ctx).(*HostExecutor); !ok {
+		return &iproute2Backend{}
+	}
+	if BackendName(ctx) == BackendNetlink {
+		return &netlinkBackend{}
+	}
+	return &iproute2Backend{}
+}
@@ -1,65 +1,80 @@
 package network
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/Shikugawa/ayame/pkg/config"
 	"go.uber.org/multierr"
-
-	log "github.com/sirupsen/logrus"
 )
 
 type Bridge struct {
-	Name      string      `json:"name"`
+	Name string `json:"name"`
+	// Lab prefixes the names of the OpenvSwitch bridge and veths.
+	Lab       string      `json:"lab,omitempty"`
 	VethPairs []*VethPair `json:"veth_pairs"`
 }
 
-func InitBridge(cfg *config.LinkConfig, dryrun bool) (*Bridge, error) {
+func InitBridge(ctx context.Context, cfg *config.LinkConfig, lab string) (*Bridge, error) {
 	if cfg.LinkMode != config.ModeBridge {
 		return nil, fmt.Errorf("invalid mode")
 	}
 
-	if err := CreateNewBridge(cfg.Name, dryrun); err != nil {
+	br := &Bridge{
+		Name: cfg.Name,
+		Lab:  lab,
+	}
+
+	if err := CreateNewBridge(ctx, br.OvsName()); err != nil {
 		return nil, err
 	}
 
-	return &Bridge{
-		Name: cfg.Name,
-	}, nil
+	return br, nil
+}
+
+// OvsName returns the name of the OpenvSwitch bridge.
+func (d *Bridge) OvsName() string {
+	return LabIfname(d.Lab, d.Name)
 }
 
 // TODO: consider error handling
-func (d *Bridge) Destroy(dryrun bool) error {
+func (d *Bridge) Destroy(ctx context.Context) error {
+	var allerr error
 	for _, p := range d.VethPairs {
-		if err := p.Destroy(dryrun); err != nil {
-			log.Warnf(err.Error())
+		if err := p.Destroy(ctx); err != nil {
+			allerr = multierr.Append(allerr, err)
 		}
 	}
 
-	if err := DeleteBridge(d.Name, dryrun); err != nil {
-		return err
+	if err := DeleteBridge(ctx, d.OvsName()); err != nil {
+		allerr = multierr.Append(allerr, err)
 	}
 
-	return nil
+	return allerr
 }
 
 // TODO: consider error handling
-func (d *Bridge) CreateLink(target *Namespace, dryrun bool) error {
+func (d *Bridge) CreateLink(ctx context.Context, target *Namespace) error {
+	// Pairs can be removed by apply, so the number is chosen not to collide.
 	num := len(d.VethPairs) + 1
+	for d.hasPair(d.Name + "-" + fmt.Sprint(num)) {
+		num++
+	}
 	conf := VethConfig{
 		Name: d.Name + "-" + fmt.Sprint(num),
+		Lab:  d.Lab,
 	}
 
-	pair, err := InitVethPair(conf, dryrun)
+	pair, err := InitVethPair(ctx, conf)
 	if err != nil {
 		return err
 	}
 
-	if err := target.Attach(&pair.Left, dryrun); err != nil {
+	if err := target.Attach(ctx, d.Name, &pair.Left); err != nil {
 		return err
 	}
 
-	if err := LinkBridge(d.Name, &pair.Right, dryrun); err != nil {
+	if err := LinkBridge(ctx, d.OvsName(), &pair.Right); err != nil {
 		return err
 	}
 	pair.Right.Attached = true
@@ -68,28 +83,44 @@ func (d *Bridge) CreateLink(target *Namespace, dryrun bool) error {
 	return nil
 }
 
-func InitBridges(links []*config.LinkConfig, dryrun bool) (map[string]*Bridge, error) {
-	brs := make(map[string]*Bridge)
-	for _, link := range links {
-		if link.LinkMode != config.ModeBridge {
+// RemoveLink deletes the veth pair attached to the namespace.
+func (d *Bridge) RemoveLink(ctx context.Context, target *Namespace) error {
+	for i, p := range d.VethPairs {
+		if !target.HasAttached(p.Left.Name) {
 			continue
 		}
 
-		br, err := InitBridge(link, dryrun)
-		if err != nil {
-			return nil, fmt.Errorf("failed to init bridge: %s: %s", link.Name, err)
+		if err := UnlinkBridge(ctx, d.OvsName(), &p.Right); err != nil {
+			return err
+		}
+
+		// Deleting the host side also deletes the other side in the namespace.
+		if err := RunIpLinkDelete(ctx, p.Right.Name); err != nil {
+			return err
 		}
 
-		brs[br.Name] = br
+		target.Detach(d.Name)
+		d.VethPairs = append(d.VethPairs[:i], d.VethPairs[i+1:]...)
+		return nil
 	}
 
-	return brs, nil
+	return fmt.Errorf("%s is not linked to bridge %s", target.Name, d.Name)
+}
+
+func (d *Bridge) hasPair(name string) bool {
+	left, _ := vethNames(d.Lab, name)
+	for _, p := range d.VethPairs {
+		if p.Left.Name == left {
+			return true
+		}
+	}
+	return false
 }
 
-func CleanupBridges(links map[string]*Bridge, dryrun bool) error {
+func CleanupBridges(ctx context.Context, links map[string]*Bridge) error {
 	var allerr error
 	for _, link := range links {
-		if err := link.Destroy(dryrun); err != nil {
+		if err := link.Destroy(ctx); err != nil {
 			allerr = multierr.Append(allerr, err)
 		}
 	}
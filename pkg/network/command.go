@@ -0,0 +1,333 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+// CommandResult is the outcome of the command executed inside the namespace.
+type CommandResult struct {
+	Command  string `json:"command"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exit_code"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// execCommand runs the command and captures its outputs. Error is set only if
+// the command couldn't run to the end, e.g. it was not found or timed out.
+func execCommand(ctx context.Context, args []string, timeout time.Duration) CommandResult {
+	if timeout == 0 {
+		timeout = settingsFrom(ctx).timeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := &Command{Name: args[0], Args: args[1:], Stdout: &stdout, Stderr: &stderr}
+	log.Infof("execute %s", cmd.String())
+
+	result := CommandResult{Command: cmd.String()}
+	err := ExecutorFrom(ctx).Run(ctx, cmd)
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		result.ExitCode = -1
+		result.Error = fmt.Sprintf("timed out after %s", timeout)
+		return result
+	}
+	if ctx.Err() == context.Canceled {
+		result.ExitCode = -1
+		result.Error = "interrupted"
+		return result
+	}
+
+	if exitErr, ok := err.(*ExitError); ok {
+		result.ExitCode = exitErr.Code
+		return result
+	}
+
+	if err != nil {
+		result.ExitCode = -1
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// RunHostCommands runs the commands on the host, e.g. lab-level hooks.
+func RunHostCommands(ctx context.Context, commands []config.CommandConfig, policy config.CommandFailurePolicy) ([]CommandResult, error) {
+	build := func(command config.CommandConfig) ([]string, error) {
+		if command.Shell {
+			return []string{"sh", "-c", command.Command}, nil
+		}
+		return splitCommand(command.Command)
+	}
+
+	return runCommands(ctx, commands, build, "host", policy)
+}
+
+func runCommands(ctx context.Context, commands []config.CommandConfig, build func(config.CommandConfig) ([]string, error),
+	where string, policy config.CommandFailurePolicy) ([]CommandResult, error) {
+	var results []CommandResult
+	var allerr error
+	for _, command := range commands {
+		result, err := runCommand(ctx, command, build, where)
+		if result != nil {
+			results = append(results, *result)
+		}
+
+		if err != nil {
+			if command.IgnoreErrors {
+				log.Warnf("ignored: %s", err)
+				continue
+			}
+
+			if policy == config.PolicyAbort {
+				return results, err
+			}
+
+			log.Warn(err.Error())
+			allerr = multierr.Append(allerr, err)
+		}
+	}
+
+	return results, allerr
+}
+
+// runCommand runs the command with retries. The result is nil on dryrun.
+func runCommand(ctx context.Context, command config.CommandConfig, build func(config.CommandConfig) ([]string, error),
+	where string) (*CommandResult, error) {
+	args, err := build(command)
+	if err != nil {
+		if IsDryRun(ctx) {
+			return nil, err
+		}
+		return &CommandResult{
+			Command:  command.Command,
+			ExitCode: -1,
+			Error:    err.Error(),
+		}, err
+	}
+
+	if IsDryRun(ctx) {
+		execCommand(ctx, args, command.Timeout)
+		return nil, nil
+	}
+
+	var result CommandResult
+	for attempt := 0; attempt <= command.Retries; attempt++ {
+		result = execCommand(ctx, args, command.Timeout)
+		result.Attempts = attempt + 1
+
+		if result.Error == "" && result.ExitCode == command.ExpectExit {
+			break
+		}
+	}
+
+	if len(result.Stdout) != 0 {
+		log.Infof("\n%s", result.Stdout)
+	}
+
+	if result.Error != "" {
+		return &result, fmt.Errorf("command %s failed in %s: %s", result.Command, where, result.Error)
+	}
+
+	if result.ExitCode != command.ExpectExit {
+		return &result, fmt.Errorf("command %s exited with %d in %s, expected %d: %s",
+			result.Command, result.ExitCode, where, command.ExpectExit, result.Stderr)
+	}
+
+	return &result, nil
+}
+
+// variablePattern matches the variables and the escaped "$$(".
+var variablePattern = regexp.MustCompile(`\$\$\(|\$\(([^()]*)\)`)
+
+// ExpandVariables replaces all the variables in the command. Supported variables are
+//
+//	$(DEVICE) or $(DEVICE.ifname): the name of the veth attached for DEVICE
+//	$(DEVICE.ip): the address assigned to DEVICE
+//	$(ns.name): the name of the namespace
+//	$(peer.NAMESPACE.DEVICE.ip): the address assigned to DEVICE in another NAMESPACE
+//
+// "$$(" is replaced with "$(", so that command substitutions like $$(hostname) reach the shell.
+func (n *Namespace) ExpandVariables(command string, peers []*Namespace) (string, error) {
+	var expandErr error
+	expanded := variablePattern.ReplaceAllStringFunc(command, func(s string) string {
+		if expandErr != nil {
+			return s
+		}
+		if s == "$$(" {
+			return "$("
+		}
+
+		name := variablePattern.FindStringSubmatch(s)[1]
+		value, err := n.resolveVariable(name, peers)
+		if err != nil {
+			expandErr = err
+			return s
+		}
+		return value
+	})
+
+	if expandErr != nil {
+		return "", fmt.Errorf("failed to expand %s: %s", command, expandErr)
+	}
+
+	return expanded, nil
+}
+
+func (n *Namespace) resolveVariable(name string, peers []*Namespace) (string, error) {
+	parts := strings.Split(name, ".")
+
+	switch {
+	case len(parts) == 2 && parts[0] == "ns":
+		switch parts[1] {
+		case "name":
+			return n.Name, nil
+		case "netns":
+			return n.NetnsName(), nil
+		}
+		return "", fmt.Errorf("unknown variable $(%s)", name)
+	case parts[0] == "peer":
+		if len(parts) != 4 {
+			return "", fmt.Errorf("unknown variable $(%s)", name)
+		}
+		for _, peer := range peers {
+			if peer.Name == parts[1] {
+				return peer.resolveDeviceVariable(parts[2], parts[3])
+			}
+		}
+		return "", fmt.Errorf("unknown namespace %s in $(%s)", parts[1], name)
+	case len(parts) == 1:
+		return n.resolveDeviceVariable(parts[0], "ifname")
+	case len(parts) == 2:
+		return n.resolveDeviceVariable(parts[0], parts[1])
+	}
+
+	return "", fmt.Errorf("unknown variable $(%s)", name)
+}
+
+func (n *Namespace) resolveDeviceVariable(device string, attr string) (string, error) {
+	for _, dev := range n.RegisteredDeviceConfig {
+		if dev.Name != device {
+			continue
+		}
+
+		switch attr {
+		case "ifname":
+			if len(dev.AttachedVeth) == 0 {
+				return "", fmt.Errorf("device %s is not attached to %s", device, n.Name)
+			}
+			return dev.AttachedVeth, nil
+		case "ip":
+			ip, _, err := net.ParseCIDR(dev.Cidr)
+			if err != nil {
+				return "", fmt.Errorf("failed to parse CIDR %s of device %s: %s", dev.Cidr, device, err)
+			}
+			return ip.String(), nil
+		}
+
+		return "", fmt.Errorf("unknown attribute %s of device %s", attr, device)
+	}
+
+	return "", fmt.Errorf("unknown device %s in namespace %s", device, n.Name)
+}
+
+// splitCommand splits the command into words with the quoting rules of POSIX shell.
+// Shell operators are rejected because they are meaningful only with shell mode.
+func splitCommand(command string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	quote := rune(0)
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+				continue
+			}
+			word.WriteRune(r)
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+				continue
+			}
+			if r == '\\' && i+1 < len(runes) && strings.ContainsRune("$`\"\\", runes[i+1]) {
+				i++
+				r = runes[i]
+			}
+			word.WriteRune(r)
+		case r == '\\':
+			if i+1 == len(runes) {
+				return nil, fmt.Errorf("malformed command: trailing backslash: %s", command)
+			}
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case strings.ContainsRune("|&;<>`", r):
+			return nil, fmt.Errorf("malformed command: %q requires shell mode: %s", r, command)
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("malformed command: unterminated quote: %s", command)
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	if len(words) == 0 {
+		return nil, fmt.Errorf("malformed command: %s", command)
+	}
+
+	return words, nil
+}
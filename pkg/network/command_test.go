@@ -0,0 +1,126 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+)
+
+func TestExpandVariables(t *testing.T) {
+	ns1 := &Namespace{
+		Name:  "ns1",
+		Netns: "ayame-lab-ns1",
+		RegisteredDeviceConfig: []RegisteredDeviceConfig{
+			{NamespaceDeviceConfig: config.NamespaceDeviceConfig{Name: "veth1", Cidr: "10.0.0.1/24"}, AttachedVeth: "1234-veth1-l"},
+			{NamespaceDeviceConfig: config.NamespaceDeviceConfig{Name: "veth2", Cidr: "10.0.1.1/24"}},
+		},
+	}
+	ns2 := &Namespace{
+		Name: "ns2",
+		RegisteredDeviceConfig: []RegisteredDeviceConfig{
+			{NamespaceDeviceConfig: config.NamespaceDeviceConfig{Name: "veth1", Cidr: "10.0.0.2/24"}, AttachedVeth: "1234-veth1-r"},
+		},
+	}
+	peers := []*Namespace{ns1, ns2}
+
+	tests := []struct {
+		name     string
+		command  string
+		expected string
+		err      string
+	}{
+		{name: "device", command: "ip link set $(veth1) up", expected: "ip link set 1234-veth1-l up"},
+		{name: "ifname", command: "echo $(veth1.ifname)", expected: "echo 1234-veth1-l"},
+		{name: "ip", command: "echo $(veth1.ip)", expected: "echo 10.0.0.1"},
+		{name: "namespace", command: "echo $(ns.name) $(ns.netns)", expected: "echo ns1 ayame-lab-ns1"},
+		{name: "peer", command: "ping -c 1 $(peer.ns2.veth1.ip)", expected: "ping -c 1 10.0.0.2"},
+		{name: "escape", command: "echo $(ns.name) on $$(hostname)", expected: "echo ns1 on $(hostname)"},
+		{name: "no variables", command: "echo $HOME", expected: "echo $HOME"},
+		{name: "unknown variable", command: "echo $(ns.id)", err: "unknown variable $(ns.id)"},
+		{name: "unknown device", command: "echo $(veth3)", err: "unknown device veth3 in namespace ns1"},
+		{name: "unknown attribute", command: "echo $(veth1.mac)", err: "unknown attribute mac of device veth1"},
+		{name: "unknown peer", command: "echo $(peer.ns3.veth1.ip)", err: "unknown namespace ns3"},
+		{name: "malformed peer", command: "echo $(peer.ns2.veth1)", err: "unknown variable $(peer.ns2.veth1)"},
+		{name: "unattached device", command: "ip link set $(veth2) up", err: "device veth2 is not attached to ns1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := ns1.ExpandVariables(tt.command, peers)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, actual %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != tt.expected {
+				t.Errorf("expected %q, actual %q", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  string
+		expected []string
+		err      string
+	}{
+		{name: "words", command: "  ip  link set\tveth1 up ", expected: []string{"ip", "link", "set", "veth1", "up"}},
+		{name: "single quotes", command: `echo 'a "b" \c $d'`, expected: []string{"echo", `a "b" \c $d`}},
+		{name: "double quotes", command: `echo "a \"b\" \\ \$d \c"`, expected: []string{"echo", `a "b" \ $d \c`}},
+		{name: "adjacent quotes", command: `echo a'b'"c"`, expected: []string{"echo", "abc"}},
+		{name: "empty quotes", command: `echo ''`, expected: []string{"echo", ""}},
+		{name: "backslash", command: `echo a\ b`, expected: []string{"echo", "a b"}},
+		{name: "quoted operators", command: "echo '|&;<>`'", expected: []string{"echo", "|&;<>`"}},
+		{name: "trailing backslash", command: `echo a\`, err: "trailing backslash"},
+		{name: "unterminated single quote", command: `echo 'a`, err: "unterminated quote"},
+		{name: "unterminated double quote", command: `echo "a`, err: "unterminated quote"},
+		{name: "pipe", command: "echo a | cat", err: "requires shell mode"},
+		{name: "and", command: "true && echo a", err: "requires shell mode"},
+		{name: "semicolon", command: "true; echo a", err: "requires shell mode"},
+		{name: "redirect in", command: "cat < a", err: "requires shell mode"},
+		{name: "redirect out", command: "echo a > b", err: "requires shell mode"},
+		{name: "backtick", command: "echo `hostname`", err: "requires shell mode"},
+		{name: "empty", command: "", err: "malformed command"},
+		{name: "blank", command: " \t ", err: "malformed command"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := splitCommand(tt.command)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, actual %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("expected %q, actual %q", tt.expected, actual)
+			}
+		})
+	}
+}
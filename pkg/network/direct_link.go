@@ -1,9 +1,11 @@
 package network
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/Shikugawa/ayame/pkg/config"
+	log "github.com/sirupsen/logrus"
 	"go.uber.org/multierr"
 )
 
@@ -12,16 +14,17 @@ type DirectLink struct {
 	Name     string `json:"name"`
 }
 
-func InitDirectLink(cfg *config.LinkConfig, dryrun bool) (*DirectLink, error) {
+func InitDirectLink(ctx context.Context, cfg *config.LinkConfig, lab string) (*DirectLink, error) {
 	if cfg.LinkMode != config.ModeDirectLink {
 		return nil, fmt.Errorf("invalid mode")
 	}
 
 	conf := VethConfig{
 		Name: cfg.Name,
+		Lab:  lab,
 	}
 
-	pair, err := InitVethPair(conf, dryrun)
+	pair, err := InitVethPair(ctx, conf)
 	if err != nil {
 		return nil, err
 	}
@@ -32,50 +35,63 @@ func InitDirectLink(cfg *config.LinkConfig, dryrun bool) (*DirectLink, error) {
 	}, nil
 }
 
-func (d *DirectLink) Destroy(dryrun bool) error {
-	return d.VethPair.Destroy(dryrun)
+func (d *DirectLink) Destroy(ctx context.Context) error {
+	return d.VethPair.Destroy(ctx)
 }
 
 // TODO: consider error handling
-func (d *DirectLink) CreateLink(left *Namespace, right *Namespace, dryrun bool) error {
+func (d *DirectLink) CreateLink(ctx context.Context, left *Namespace, right *Namespace) error {
 	if d.VethPair.Left.Attached && d.VethPair.Right.Attached {
 		return fmt.Errorf("%s has been already busy\n", d.Name)
 	}
 
-	if err := (*left).Attach(&d.VethPair.Left, dryrun); err != nil {
+	if err := (*left).Attach(ctx, d.Name, &d.VethPair.Left); err != nil {
 		return err
 	}
 
-	if err := (*right).Attach(&d.VethPair.Right, dryrun); err != nil {
-		// TODO: add error handling if left succeeded but right failed.
+	if err := (*right).Attach(ctx, d.Name, &d.VethPair.Right); err != nil {
+		// Leave the link detached as a whole so that the state matches the kernel.
+		if rerr := (*left).Release(ctx, d.Name, &d.VethPair.Left); rerr != nil {
+			return multierr.Append(err, rerr)
+		}
 		return err
 	}
 
 	return nil
 }
 
-func InitDirectLinks(links []*config.LinkConfig, dryrun bool) (map[string]*DirectLink, error) {
-	dlinks := make(map[string]*DirectLink)
-	for _, link := range links {
-		if link.LinkMode != config.ModeDirectLink {
-			continue
+// RemoveLink deletes the veth pair wherever its ends are. The pair which has already
+// gone is skipped, since a removal interrupted by a crash isn't in the state.
+func (d *DirectLink) RemoveLink(ctx context.Context, namespaces []*Namespace) error {
+	for _, v := range []Veth{d.VethPair.Left, d.VethPair.Right} {
+		if !v.Attached {
+			return deleteHostLink(ctx, v.Name)
 		}
 
-		dlink, err := InitDirectLink(link, dryrun)
-		if err != nil {
-			return nil, fmt.Errorf("failed to init direct link: %s: %s", link.Name, err)
+		for _, ns := range namespaces {
+			if ns.HasAttached(v.Name) {
+				if IsDryRun(ctx) || linkExists(ctx, v.Name, ns.NetnsName()) {
+					if err := RunIpLinkDeleteInNamespace(ctx, v.Name, ns.NetnsName()); err != nil {
+						return err
+					}
+				}
+
+				for _, n := range namespaces {
+					n.Detach(d.Name)
+				}
+				return nil
+			}
 		}
-
-		dlinks[dlink.Name] = dlink
 	}
 
-	return dlinks, nil
+	log.Infof("veth-pair %s@%s is not found", d.VethPair.Left.Name, d.VethPair.Right.Name)
+	return nil
 }
 
-func CleanupDirectLinks(links map[string]*DirectLink, dryrun bool) error {
+func CleanupDirectLinks(ctx context.Context, links map[string]*DirectLink) error {
 	var allerr error
 	for _, link := range links {
-		if err := link.Destroy(dryrun); err != nil {
+		if err := link.Destroy(ctx); err != nil {
 			allerr = multierr.Append(allerr, err)
 		}
 	}
@@ -0,0 +1,53 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// execute logs the command and runs it by the executor of ctx. It is killed when ctx
+// is done or it times out.
+func execute(ctx context.Context, cmd *Command) error {
+	log.Infof("execute %s", cmd.String())
+
+	if timeout := settingsFrom(ctx).timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if err := ExecutorFrom(ctx).Run(ctx, cmd); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+func run(ctx context.Context, name string, args ...string) error {
+	return execute(ctx, &Command{Name: name, Args: args})
+}
+
+// output runs the command like run, and returns its stdout.
+func output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	err := execute(ctx, &Command{Name: name, Args: args, Stdout: &stdout})
+	return stdout.Bytes(), err
+}
@@ -0,0 +1,290 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Command is a command executed by ayame.
+type Command struct {
+	Name string
+	Args []string
+	// Stdout and Stderr receive the outputs if they are set.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func (c *Command) String() string {
+	return CommandLine(c.Name, c.Args)
+}
+
+var safeWord = regexp.MustCompile(`^[A-Za-z0-9@%+=:,./_-]+$`)
+
+// ShellQuote quotes the word for bash unless it is safe as it is.
+func ShellQuote(word string) string {
+	if safeWord.MatchString(word) {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// CommandLine returns the command as it is typed in bash.
+func CommandLine(name string, args []string) string {
+	words := []string{ShellQuote(name)}
+	for _, a := range args {
+		words = append(words, ShellQuote(a))
+	}
+	return strings.Join(words, " ")
+}
+
+// ExitError is returned when the command exited with non-zero code.
+type ExitError struct {
+	Code   int
+	Stderr string
+}
+
+func (e *ExitError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("exit status %d", e.Code)
+	}
+	return fmt.Sprintf("exit status %d: %s", e.Code, e.Stderr)
+}
+
+// Executor executes the commands which change or inspect the host. It is carried by
+// the context, so that the flows can be run without changing the host.
+type Executor interface {
+	// Run runs the command to the end. It returns ExitError if the command exited with non-zero code.
+	Run(ctx context.Context, cmd *Command) error
+	// Start starts the command detached from ayame, and returns its PID.
+	Start(cmd *Command) (int, error)
+}
+
+// settings are how the commands of the context are executed. They are carried by the
+// context together with the executor.
+type settings struct {
+	executor    Executor
+	backend     string
+	timeout     time.Duration
+	parallelism int
+	recorder    Recorder
+}
+
+type settingsKey struct{}
+
+func settingsFrom(ctx context.Context) settings {
+	if s, ok := ctx.Value(settingsKey{}).(settings); ok {
+		return s
+	}
+	return settings{backend: BackendIproute2, parallelism: 1}
+}
+
+func withSettings(ctx context.Context, update func(s *settings)) context.Context {
+	s := settingsFrom(ctx)
+	update(&s)
+	return context.WithValue(ctx, settingsKey{}, s)
+}
+
+// WithExecutor returns the context whose commands are executed by e.
+func WithExecutor(ctx context.Context, e Executor) context.Context {
+	return withSettings(ctx, func(s *settings) { s.executor = e })
+}
+
+// ExecutorFrom returns the executor of the context. Commands are executed on the host by default.
+func ExecutorFrom(ctx context.Context) Executor {
+	if e := settingsFrom(ctx).executor; e != nil {
+		return e
+	}
+	return &HostExecutor{}
+}
+
+// WithCommandTimeout returns the context whose commands are killed after the timeout.
+// Zero means no timeout. Commands in the config can override it with their own timeout.
+func WithCommandTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return withSettings(ctx, func(s *settings) { s.timeout = timeout })
+}
+
+// IsDryRun reports whether the commands of the context are only recorded.
+func IsDryRun(ctx context.Context) bool {
+	_, ok := ExecutorFrom(ctx).(*DryRunExecutor)
+	return ok
+}
+
+// IsHermetic reports whether the commands of the context don't reach the host. Flows
+// with such executors don't touch files on the host either, so that they can be tested.
+func IsHermetic(ctx context.Context) bool {
+	switch ExecutorFrom(ctx).(type) {
+	case *DryRunExecutor, *FakeExecutor:
+		return true
+	}
+	return false
+}
+
+// WithoutCancel returns the context which carries the executor and the settings of ctx
+// but is never cancelled, so that rollbacks run to the end after ctx has been cancelled.
+func WithoutCancel(ctx context.Context) context.Context {
+	return context.WithValue(context.Background(), settingsKey{}, settingsFrom(ctx))
+}
+
+// HostExecutor executes the commands on the host.
+type HostExecutor struct{}
+
+func (e *HostExecutor) Run(ctx context.Context, cmd *Command) error {
+	c := exec.CommandContext(ctx, cmd.Name, cmd.Args...)
+	c.Stdout = cmd.Stdout
+
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	if cmd.Stderr != nil {
+		c.Stderr = io.MultiWriter(&stderr, cmd.Stderr)
+	}
+
+	err := c.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+		return &ExitError{Code: exitErr.ExitCode(), Stderr: strings.TrimSpace(stderr.String())}
+	}
+	return err
+}
+
+func (e *HostExecutor) Start(cmd *Command) (int, error) {
+	c := exec.Command(cmd.Name, cmd.Args...)
+	// Detach from ayame so that the process survives after ayame exits.
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	c.Stdout = cmd.Stdout
+	c.Stderr = cmd.Stderr
+
+	if err := c.Start(); err != nil {
+		return 0, err
+	}
+
+	pid := c.Process.Pid
+	if err := c.Process.Release(); err != nil {
+		return 0, err
+	}
+	return pid, nil
+}
+
+// RecordedCommand is a command recorded by the executor.
+type RecordedCommand struct {
+	Name string
+	Args []string
+	// Detached is set if the command was started detached from ayame.
+	Detached bool
+}
+
+func (c *RecordedCommand) String() string {
+	return CommandLine(c.Name, c.Args)
+}
+
+// transcript is the list of the executed commands.
+type transcript struct {
+	mu       sync.Mutex
+	commands []RecordedCommand
+}
+
+func (t *transcript) add(cmd *Command, detached bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	args := append([]string(nil), cmd.Args...)
+	t.commands = append(t.commands, RecordedCommand{Name: cmd.Name, Args: args, Detached: detached})
+}
+
+// Transcript returns the commands in the executed order.
+func (t *transcript) Transcript() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var lines []string
+	for _, c := range t.commands {
+		lines = append(lines, c.String())
+	}
+	return lines
+}
+
+// Commands returns the recorded commands in the executed order.
+func (t *transcript) Commands() []RecordedCommand {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]RecordedCommand(nil), t.commands...)
+}
+
+// DryRunExecutor only records the commands. Commands succeed with no output.
+type DryRunExecutor struct {
+	transcript
+}
+
+func (e *DryRunExecutor) Run(ctx context.Context, cmd *Command) error {
+	e.add(cmd, false)
+	return nil
+}
+
+func (e *DryRunExecutor) Start(cmd *Command) (int, error) {
+	e.add(cmd, true)
+	return 0, nil
+}
+
+// FakeExecutor records the commands and answers them with Respond, so that the flows
+// can be tested without root privileges. Flows running with it don't write the journal
+// nor logs of services, and processes on the host are never signalled.
+type FakeExecutor struct {
+	transcript
+
+	// Respond returns the stdout and the error of the command. Commands succeed with
+	// no output if it is nil.
+	Respond func(cmd *Command) (string, error)
+
+	pid int
+}
+
+func (e *FakeExecutor) Run(ctx context.Context, cmd *Command) error {
+	e.add(cmd, false)
+	return e.respond(cmd)
+}
+
+func (e *FakeExecutor) Start(cmd *Command) (int, error) {
+	e.add(cmd, true)
+	if err := e.respond(cmd); err != nil {
+		return 0, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.pid++
+	return e.pid, nil
+}
+
+func (e *FakeExecutor) respond(cmd *Command) error {
+	if e.Respond == nil {
+		return nil
+	}
+
+	out, err := e.Respond(cmd)
+	if cmd.Stdout != nil {
+		io.WriteString(cmd.Stdout, out)
+	}
+	return err
+}
@@ -0,0 +1,168 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		word     string
+		expected string
+	}{
+		{word: "ip", expected: "ip"},
+		{word: "10.0.0.1/24", expected: "10.0.0.1/24"},
+		{word: "", expected: "''"},
+		{word: "echo ns2 on $(hostname)", expected: "'echo ns2 on $(hostname)'"},
+		{word: "a|b", expected: "'a|b'"},
+		{word: "it's", expected: `'it'\''s'`},
+	}
+
+	for _, tt := range tests {
+		if actual := ShellQuote(tt.word); actual != tt.expected {
+			t.Errorf("%q: expected %s, actual %s", tt.word, tt.expected, actual)
+		}
+	}
+}
+
+func TestDryRunExecutor(t *testing.T) {
+	e := &DryRunExecutor{}
+	ctx := WithExecutor(context.Background(), e)
+	if !IsDryRun(ctx) || !IsHermetic(ctx) {
+		t.Fatal("dry run is not detected")
+	}
+
+	out, err := output(ctx, "ip", "netns", "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 0 {
+		t.Errorf("expected no output, actual %q", out)
+	}
+	if _, err := e.Start(&Command{Name: "sh", Args: []string{"-c", "sleep 1000"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"ip netns list", "sh -c 'sleep 1000'"}
+	if actual := e.Transcript(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %q, actual %q", expected, actual)
+	}
+	commands := e.Commands()
+	if commands[0].Detached || !commands[1].Detached {
+		t.Errorf("only the started command should be detached: %+v", commands)
+	}
+}
+
+func TestFakeExecutor(t *testing.T) {
+	e := &FakeExecutor{Respond: func(cmd *Command) (string, error) {
+		if cmd.Name == "false" {
+			return "", &ExitError{Code: 1, Stderr: "failed"}
+		}
+		return "ok", nil
+	}}
+	ctx := WithExecutor(context.Background(), e)
+	if IsDryRun(ctx) || !IsHermetic(ctx) {
+		t.Fatal("fake executor is not detected as hermetic")
+	}
+
+	var stdout bytes.Buffer
+	if err := e.Run(ctx, &Command{Name: "echo", Stdout: &stdout}); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "ok" {
+		t.Errorf("expected output ok, actual %q", stdout.String())
+	}
+
+	var exitErr *ExitError
+	if err := run(ctx, "false"); !errors.As(err, &exitErr) || exitErr.Code != 1 {
+		t.Errorf("expected exit status 1, actual %v", err)
+	}
+
+	for want := 1; want <= 2; want++ {
+		pid, err := e.Start(&Command{Name: "sleep", Args: []string{"1000"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pid != want {
+			t.Errorf("expected pid %d, actual %d", want, pid)
+		}
+	}
+	if _, err := e.Start(&Command{Name: "false"}); err == nil {
+		t.Error("start of a failing command succeeded")
+	}
+
+	expected := []string{"echo", "false", "sleep 1000", "sleep 1000", "false"}
+	if actual := e.Transcript(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %q, actual %q", expected, actual)
+	}
+}
+
+func TestSettingsOfContext(t *testing.T) {
+	e := &FakeExecutor{}
+	r := &recordedSteps{}
+	ctx, err := WithBackend(WithExecutor(context.Background(), e), BackendNetlink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = WithRecorder(WithCommandTimeout(WithParallelism(ctx, 4), time.Minute), r)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	ctx = WithoutCancel(cancelled)
+
+	if ctx.Err() != nil {
+		t.Error("context is cancelled")
+	}
+	if ExecutorFrom(ctx) != e || BackendName(ctx) != BackendNetlink || settingsFrom(ctx).timeout != time.Minute {
+		t.Errorf("settings are lost: %+v", settingsFrom(ctx))
+	}
+	// Commands which aren't executed on the host are recorded in a stable order by iproute2.
+	if Parallelism(ctx) != 1 {
+		t.Errorf("expected parallelism 1, actual %d", Parallelism(ctx))
+	}
+	if _, ok := backendFor(ctx).(*iproute2Backend); !ok {
+		t.Errorf("expected iproute2 backend, actual %T", backendFor(ctx))
+	}
+
+	if err := RunIpNetnsAdd(ctx, "ns1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.steps) != 1 || r.steps[0].Op != StepNetnsAdd {
+		t.Errorf("expected the step of netns add, actual %v", r.steps)
+	}
+
+	if _, err := WithBackend(context.Background(), "unknown"); err == nil {
+		t.Error("unknown backend is accepted")
+	}
+}
+
+type recordedSteps struct {
+	steps []Step
+}
+
+func (r *recordedSteps) Record(step Step) error {
+	r.steps = append(r.steps, step)
+	return nil
+}
+
+func (r *recordedSteps) Discard(step Step) error {
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// WithParallelism returns the context whose operations are run n at the same time. It is at least 1.
+func WithParallelism(ctx context.Context, n int) context.Context {
+	if n < 1 {
+		n = 1
+	}
+	return withSettings(ctx, func(s *settings) { s.parallelism = n })
+}
+
+// Parallelism returns the number of workers for ctx. Dry runs use a single worker,
+// so that the recorded commands are in a stable order.
+func Parallelism(ctx context.Context) int {
+	if _, ok := ExecutorFrom(ctx).(*HostExecutor); !ok {
+		return 1
+	}
+	return settingsFrom(ctx).parallelism
+}
+
+type operation struct {
+	name    string
+	deps    []*operation
+	fn      func(ctx context.Context) error
+	started bool
+	done    bool
+}
+
+// Graph runs operations after all the operations they depend on. Independent operations
+// run concurrently, and ready ones start in the order they were added, so that a single
+// worker runs them in exactly that order.
+type Graph struct {
+	ops    []*operation
+	byName map[string]*operation
+	mu     sync.Mutex
+}
+
+// NewGraph returns an empty graph.
+func NewGraph() *Graph {
+	return &Graph{byName: make(map[string]*operation)}
+}
+
+// Add adds the operation which runs after deps. The dependencies must have been added before.
+func (g *Graph) Add(name string, deps []string, fn func(ctx context.Context) error) error {
+	if _, ok := g.byName[name]; ok {
+		return fmt.Errorf("operation %s is added twice", name)
+	}
+
+	op := &operation{name: name, fn: fn}
+	for _, d := range deps {
+		dep, ok := g.byName[d]
+		if !ok {
+			return fmt.Errorf("operation %s depends on unknown operation %s", name, d)
+		}
+		op.deps = append(op.deps, dep)
+	}
+
+	g.ops = append(g.ops, op)
+	g.byName[name] = op
+	return nil
+}
+
+// Started reports whether the operation has been started by Run.
+func (g *Graph) Started(name string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	op, ok := g.byName[name]
+	return ok && op.started
+}
+
+// Run runs the operations with at most workers at the same time. After an operation fails
+// or ctx is done, no more operations start, and Run returns the error of the earliest
+// added operation among the failed ones once the running ones finish.
+func (g *Graph) Run(ctx context.Context, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	type result struct {
+		op  *operation
+		err error
+	}
+	results := make(chan result)
+
+	var errs map[*operation]error
+	running := 0
+	stopped := false
+
+	ready := func(op *operation) bool {
+		if op.started {
+			return false
+		}
+		for _, d := range op.deps {
+			if !d.done {
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		if !stopped && ctx.Err() != nil {
+			stopped = true
+		}
+
+		// Start the ready operations in the order they were added.
+		g.mu.Lock()
+		for _, op := range g.ops {
+			if stopped || running == workers {
+				break
+			}
+			if !ready(op) {
+				continue
+			}
+
+			op.started = true
+			running++
+			go func(op *operation) {
+				results <- result{op: op, err: op.fn(ctx)}
+			}(op)
+		}
+		g.mu.Unlock()
+
+		if running == 0 {
+			break
+		}
+
+		res := <-results
+		running--
+
+		g.mu.Lock()
+		if res.err != nil {
+			if errs == nil {
+				errs = make(map[*operation]error)
+			}
+			errs[res.op] = res.err
+			stopped = true
+		} else {
+			res.op.done = true
+		}
+		g.mu.Unlock()
+	}
+
+	for _, op := range g.ops {
+		if err, ok := errs[op]; ok {
+			return err
+		}
+	}
+
+	for _, op := range g.ops {
+		if !op.done {
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("interrupted before %s: %s", op.name, err)
+			}
+			return fmt.Errorf("operation %s couldn't run", op.name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ResourceTag is set to the alias of veths and the external_ids of bridges created by ayame.
+const ResourceTag = "ayame"
+
+// LinkInfo is a network interface seen by the kernel.
+type LinkInfo struct {
+	Name  string
+	Alias string
+	// Peer is the other end of the veth if it is in the same namespace.
+	Peer      string
+	Up        bool
+	OperState string
+	Cidrs     []string
+}
+
+// RouteInfo is a route seen by the kernel.
+type RouteInfo struct {
+	To     string
+	Via    string
+	Device string
+}
+
+// ListNetns returns the names of the named network namespaces.
+func ListNetns(ctx context.Context) map[string]bool {
+	nss, err := backendFor(ctx).listNetns(ctx)
+	if err != nil {
+		log.Warnf("failed to list ns: %s", err)
+		return make(map[string]bool)
+	}
+	return nss
+}
+
+// inspect runs the command which only reads the host, and returns its stdout.
+func inspect(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd := &Command{Name: name, Args: args, Stdout: &stdout}
+	log.Debugln("execute ", cmd.String())
+
+	if err := ExecutorFrom(ctx).Run(ctx, cmd); err != nil {
+		return nil, fmt.Errorf("failed to execute %s: %s", cmd.String(), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// ListLinks returns the interfaces in the namespace. Host interfaces are returned if nsname is empty.
+func ListLinks(ctx context.Context, nsname string) (map[string]LinkInfo, error) {
+	return backendFor(ctx).listLinks(ctx, nsname)
+}
+
+// ListRoutes returns the IPv4 and IPv6 routes in the namespace.
+func ListRoutes(ctx context.Context, nsname string) ([]RouteInfo, error) {
+	return backendFor(ctx).listRoutes(ctx, nsname)
+}
+
+// NormalizeRouteDestination returns the destination in the form printed by the kernel.
+func NormalizeRouteDestination(to string) string {
+	_, ipnet, err := net.ParseCIDR(to)
+	if err != nil {
+		return to
+	}
+
+	if ones, bits := ipnet.Mask.Size(); ones == bits {
+		return ipnet.IP.String()
+	}
+	return ipnet.String()
+}
+
+// BridgeExists reports whether the OpenvSwitch bridge exists.
+func BridgeExists(ctx context.Context, name string) (bool, error) {
+	cmd := &Command{Name: "ovs-vsctl", Args: []string{"br-exists", name}}
+	log.Debugln("execute ", cmd.String())
+
+	err := ExecutorFrom(ctx).Run(ctx, cmd)
+	if err == nil {
+		return true, nil
+	}
+	// br-exists exits with 2 if the bridge doesn't exist.
+	if exitErr, ok := err.(*ExitError); ok && exitErr.Code == 2 {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to execute %s: %s", cmd.String(), err)
+}
+
+// ListBridgePorts returns the ports added to the OpenvSwitch bridge.
+func ListBridgePorts(ctx context.Context, name string) (map[string]bool, error) {
+	out, err := inspect(ctx, "ovs-vsctl", "list-ports", name)
+	if err != nil {
+		return nil, err
+	}
+
+	ports := make(map[string]bool)
+	for _, port := range strings.Fields(string(out)) {
+		ports[port] = true
+	}
+	return ports, nil
+}
+
+// OvsAvailable reports whether ovs-vsctl runs by the executor of ctx.
+func OvsAvailable(ctx context.Context) bool {
+	_, err := inspect(ctx, "ovs-vsctl", "--version")
+	return err == nil
+}
+
+// ListTaggedBridges returns the OpenvSwitch bridges created by ayame.
+func ListTaggedBridges(ctx context.Context) ([]string, error) {
+	out, err := inspect(ctx, "ovs-vsctl", "--bare", "--columns=name", "find", "bridge", "external_ids:"+ResourceTag+"=true")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
@@ -15,124 +15,335 @@
 package network
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"os/exec"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func RunIpLinkCreate(left string, right string, dryrun bool) error {
-	cmd := exec.Command("ip", "link", "add", "name", left, "type", "veth", "peer", right)
-	log.Infoln("execute ", cmd.String())
-
-	if dryrun {
-		return nil
+func RunIpLinkCreate(ctx context.Context, left string, right string) error {
+	if err := change(ctx, Step{Op: StepVethAdd, Args: []string{left}}, func() error {
+		return backendFor(ctx).addVeth(ctx, left, right)
+	}); err != nil {
+		return fmt.Errorf("failed to create veth name %s@%s: %s", left, right, err)
 	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create veth name %s@%s: %s", left, right, err)
+	return nil
+}
+
+// RunIpLinkSetAlias tags the device. The alias is kept after moving it to another namespace.
+func RunIpLinkSetAlias(ctx context.Context, ifname string, alias string) error {
+	if err := backendFor(ctx).setAlias(ctx, ifname, alias); err != nil {
+		return fmt.Errorf("failed to set alias of %s: %s", ifname, err)
 	}
 
 	return nil
 }
 
-func RunIpLinkDelete(name string, dryrun bool) error {
-	cmd := exec.Command("ip", "link", "delete", name)
-	log.Infoln("execute ", cmd.String())
+func RunIpLinkDelete(ctx context.Context, name string) error {
+	if err := backendFor(ctx).deleteLink(ctx, name, ""); err != nil {
+		return fmt.Errorf("failed to delete device %s: %s", name, err)
+	}
+
+	return nil
+}
 
-	if dryrun {
-		return nil
+func RunIpLinkSetNamespaces(ctx context.Context, ifname string, nsname string) error {
+	if err := change(ctx, Step{Op: StepLinkSetNetns, Args: []string{ifname, nsname}}, func() error {
+		return backendFor(ctx).setNetns(ctx, ifname, nsname)
+	}); err != nil {
+		return fmt.Errorf("failed to attach device %s to ns %s: %s", ifname, nsname, err)
 	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to delete device %s: %s", name, err)
+	return nil
+}
+
+// RunIpLinkSetHost moves the device in the namespace back to the host.
+func RunIpLinkSetHost(ctx context.Context, ifname string, nsname string) error {
+	if err := backendFor(ctx).setHostNetns(ctx, ifname, nsname); err != nil {
+		return fmt.Errorf("failed to move device %s in ns %s to host: %s", ifname, nsname, err)
 	}
 
 	return nil
 }
 
-func RunIpLinkSetNamespaces(ifname string, nsname string, dryrun bool) error {
-	cmd := exec.Command("ip", "link", "set", ifname, "netns", nsname)
-	log.Infoln("execute ", cmd.String())
+func RunAssignCidrToNamespaces(ctx context.Context, ifname string, nsname string, cidr string) error {
+	if err := change(ctx, Step{Op: StepAddrAdd, Args: []string{ifname, nsname, cidr}}, func() error {
+		return backendFor(ctx).addAddr(ctx, ifname, nsname, cidr)
+	}); err != nil {
+		return fmt.Errorf("failed to assign CIDR %s to ns %s on %s: %s", cidr, nsname, ifname, err)
+	}
+
+	return nil
+}
 
-	if dryrun {
-		return nil
+func RunIpLinkDeleteInNamespace(ctx context.Context, ifname string, nsname string) error {
+	if err := backendFor(ctx).deleteLink(ctx, ifname, nsname); err != nil {
+		return fmt.Errorf("failed to delete device %s in ns %s: %s", ifname, nsname, err)
 	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to attach device %s to ns %s", ifname, nsname)
+	return nil
+}
+
+func RunDeleteCidrFromNamespaces(ctx context.Context, ifname string, nsname string, cidr string) error {
+	if err := backendFor(ctx).deleteAddr(ctx, ifname, nsname, cidr); err != nil {
+		return fmt.Errorf("failed to delete CIDR %s from ns %s on %s: %s", cidr, nsname, ifname, err)
 	}
 
 	return nil
 }
 
-func RunAssignCidrToNamespaces(ifname string, nsname string, cidr string, dryrun bool) error {
-	cmd := exec.Command("ip", "netns", "exec", nsname, "ip", "addr", "add", cidr, "dev", ifname)
-	log.Infoln("execute ", cmd.String())
+// RunIpRoute adds or deletes the route inside the namespace. ifname can be empty.
+func RunIpRoute(ctx context.Context, op string, nsname string, to string, via string, ifname string) error {
+	fn := func() error {
+		return backendFor(ctx).route(ctx, op, nsname, to, via, ifname)
+	}
 
-	if dryrun {
-		return nil
+	var err error
+	if op == "add" {
+		err = change(ctx, Step{Op: StepRouteAdd, Args: []string{nsname, to, via, ifname}}, fn)
+	} else {
+		err = fn()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to %s route %s in ns %s: %s", op, to, nsname, err)
 	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to assign CIDR %s to ns %s on %s", cidr, nsname, ifname)
+	return nil
+}
+
+func RunIpLinkSetState(ctx context.Context, ifname string, nsname string, up bool) error {
+	if err := backendFor(ctx).setLinkState(ctx, ifname, nsname, up); err != nil {
+		return fmt.Errorf("failed to set %s %s in ns %s: %s", ifname, linkState(up), nsname, err)
 	}
 
 	return nil
 }
 
-func RunIpNetnsAdd(nsname string, dryrun bool) error {
-	cmd := exec.Command("ip", "netns", "add", nsname)
-	log.Infoln("execute ", cmd.String())
+// RunTcNetem replaces the root qdisc of the device with netem. Empty args removes it.
+func RunTcNetem(ctx context.Context, ifname string, nsname string, args []string) error {
+	if err := backendFor(ctx).setNetem(ctx, ifname, nsname, args); err != nil {
+		return fmt.Errorf("failed to set netem on %s in ns %s: %s", ifname, nsname, err)
+	}
+
+	return nil
+}
 
-	if dryrun {
-		return nil
+func RunIpNetnsAdd(ctx context.Context, nsname string) error {
+	if err := change(ctx, Step{Op: StepNetnsAdd, Args: []string{nsname}}, func() error {
+		return backendFor(ctx).addNetns(ctx, nsname)
+	}); err != nil {
+		return fmt.Errorf("failed to create ns %s: %s", nsname, err)
 	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create ns %s", nsname)
+	return nil
+}
+
+func RunIpNetnsDelete(ctx context.Context, nsname string) error {
+	if err := backendFor(ctx).deleteNetns(ctx, nsname); err != nil {
+		return fmt.Errorf("failed to delete ns %s: %s", nsname, err)
 	}
 
 	return nil
 }
 
-func RunIpNetnsDelete(nsname string, dryrun bool) error {
-	cmd := exec.Command("ip", "netns", "delete", nsname)
-	log.Infoln("execute ", cmd.String())
+func CheckIpNetnsExists(ctx context.Context, nsname string) bool {
+	exists, err := backendFor(ctx).netnsExists(ctx, nsname)
+	if err != nil {
+		log.Warnf("failed to check ns %s: %s", nsname, err)
+		return false
+	}
 
-	if dryrun {
-		return nil
+	return exists
+}
+
+func linkState(up bool) string {
+	if up {
+		return "up"
 	}
+	return "down"
+}
+
+// iproute2Backend runs the commands of iproute2.
+type iproute2Backend struct{}
+
+func (b *iproute2Backend) addNetns(ctx context.Context, name string) error {
+	return run(ctx, "ip", "netns", "add", name)
+}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to delete ns %s", nsname)
+func (b *iproute2Backend) deleteNetns(ctx context.Context, name string) error {
+	return run(ctx, "ip", "netns", "delete", name)
+}
+
+func (b *iproute2Backend) netnsExists(ctx context.Context, name string) (bool, error) {
+	nss, err := b.listNetns(ctx)
+	if err != nil {
+		return false, err
 	}
+	return nss[name], nil
+}
 
-	return nil
+func (b *iproute2Backend) listNetns(ctx context.Context) (map[string]bool, error) {
+	out, err := inspect(ctx, "ip", "netns", "list")
+	if err != nil {
+		return nil, err
+	}
+
+	// Each line is the name optionally followed by the id, e.g. "ns1 (id: 0)".
+	nss := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) != 0 {
+			nss[fields[0]] = true
+		}
+	}
+	return nss, nil
 }
 
-func CheckIpNetnsExists(nsname string, dryrun bool) bool {
-	cmd := exec.Command("ip", "netns", "list")
-	log.Infoln("execute ", cmd.String())
+func (b *iproute2Backend) addVeth(ctx context.Context, left string, right string) error {
+	return run(ctx, "ip", "link", "add", "name", left, "type", "veth", "peer", right)
+}
 
-	if dryrun {
-		return false
+func (b *iproute2Backend) setAlias(ctx context.Context, ifname string, alias string) error {
+	return run(ctx, "ip", "link", "set", "dev", ifname, "alias", alias)
+}
+
+func (b *iproute2Backend) deleteLink(ctx context.Context, ifname string, nsname string) error {
+	if nsname == "" {
+		return run(ctx, "ip", "link", "delete", ifname)
+	}
+	return run(ctx, "ip", "netns", "exec", nsname, "ip", "link", "delete", ifname)
+}
+
+func (b *iproute2Backend) linkExists(ctx context.Context, ifname string, nsname string) (bool, error) {
+	args := []string{"link", "show", "dev", ifname}
+	if nsname != "" {
+		if exists, err := b.netnsExists(ctx, nsname); !exists {
+			return false, err
+		}
+		args = append([]string{"-n", nsname}, args...)
+	}
+
+	err := run(ctx, "ip", args...)
+	if _, ok := err.(*ExitError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *iproute2Backend) setNetns(ctx context.Context, ifname string, nsname string) error {
+	return run(ctx, "ip", "link", "set", ifname, "netns", nsname)
+}
+
+func (b *iproute2Backend) setHostNetns(ctx context.Context, ifname string, nsname string) error {
+	return run(ctx, "ip", "-n", nsname, "link", "set", ifname, "netns", "1")
+}
+
+func (b *iproute2Backend) setLinkState(ctx context.Context, ifname string, nsname string, up bool) error {
+	return run(ctx, "ip", "netns", "exec", nsname, "ip", "link", "set", ifname, linkState(up))
+}
+
+func (b *iproute2Backend) addAddr(ctx context.Context, ifname string, nsname string, cidr string) error {
+	return run(ctx, "ip", "netns", "exec", nsname, "ip", "addr", "add", cidr, "dev", ifname)
+}
+
+func (b *iproute2Backend) deleteAddr(ctx context.Context, ifname string, nsname string, cidr string) error {
+	return run(ctx, "ip", "netns", "exec", nsname, "ip", "addr", "del", cidr, "dev", ifname)
+}
+
+func (b *iproute2Backend) route(ctx context.Context, op string, nsname string, to string, via string, ifname string) error {
+	args := []string{"netns", "exec", nsname, "ip", "route", op, to}
+	if via != "" {
+		args = append(args, "via", via)
+	}
+	if ifname != "" {
+		args = append(args, "dev", ifname)
 	}
 
-	output, err := cmd.Output()
+	return run(ctx, "ip", args...)
+}
+
+func ipJSON(ctx context.Context, nsname string, args ...string) ([]byte, error) {
+	if nsname != "" {
+		args = append([]string{"-n", nsname}, args...)
+	}
+	return inspect(ctx, "ip", append([]string{"-j"}, args...)...)
+}
+
+func (b *iproute2Backend) listLinks(ctx context.Context, nsname string) (map[string]LinkInfo, error) {
+	// Aliases are shown only with details.
+	out, err := ipJSON(ctx, nsname, "-d", "addr", "show")
 	if err != nil {
-		return false
+		return nil, err
 	}
 
-	s := string(output)
-	nslists := strings.Split(s, "\n")
+	var entries []struct {
+		Ifname    string   `json:"ifname"`
+		Alias     string   `json:"ifalias"`
+		Link      string   `json:"link"`
+		Flags     []string `json:"flags"`
+		OperState string   `json:"operstate"`
+		AddrInfo  []struct {
+			Local     string `json:"local"`
+			Prefixlen int    `json:"prefixlen"`
+		} `json:"addr_info"`
+	}
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse interfaces: %s", err)
+	}
 
-	for _, ns := range nslists {
-		if strings.HasPrefix(ns, nsname) {
-			return true
+	links := make(map[string]LinkInfo)
+	for _, e := range entries {
+		link := LinkInfo{Name: e.Ifname, Alias: e.Alias, Peer: e.Link, OperState: strings.ToLower(e.OperState)}
+		for _, f := range e.Flags {
+			if f == "UP" {
+				link.Up = true
+			}
+		}
+		for _, a := range e.AddrInfo {
+			link.Cidrs = append(link.Cidrs, fmt.Sprintf("%s/%d", a.Local, a.Prefixlen))
 		}
+		links[e.Ifname] = link
 	}
+	return links, nil
+}
+
+func (b *iproute2Backend) listRoutes(ctx context.Context, nsname string) ([]RouteInfo, error) {
+	var routes []RouteInfo
+	for _, family := range []string{"-4", "-6"} {
+		out, err := ipJSON(ctx, nsname, family, "route", "show")
+		if err != nil {
+			return nil, err
+		}
+
+		var entries []struct {
+			Dst     string `json:"dst"`
+			Gateway string `json:"gateway"`
+			Dev     string `json:"dev"`
+		}
+		if err := json.Unmarshal(out, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse routes: %s", err)
+		}
+
+		for _, e := range entries {
+			routes = append(routes, RouteInfo{To: NormalizeRouteDestination(e.Dst), Via: e.Gateway, Device: e.Dev})
+		}
+	}
+	return routes, nil
+}
+
+func (b *iproute2Backend) setNetem(ctx context.Context, ifname string, nsname string, args []string) error {
+	tcArgs := []string{"netns", "exec", nsname, "tc", "qdisc"}
+	if len(args) == 0 {
+		tcArgs = append(tcArgs, "del", "dev", ifname, "root")
+	} else {
+		tcArgs = append(tcArgs, "replace", "dev", ifname, "root", "netem")
+		tcArgs = append(tcArgs, args...)
+	}
+	return run(ctx, "ip", tcArgs...)
+}
 
-	return false
+func (b *iproute2Backend) execArgs(nsname string, args []string) ([]string, error) {
+	return append([]string{"ip", "netns", "exec", nsname}, args...), nil
 }
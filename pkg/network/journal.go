@@ -0,0 +1,181 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of the steps recorded in the journal.
+const (
+	StepNetnsAdd      = "netns_add"
+	StepVethAdd       = "veth_add"
+	StepLinkSetNetns  = "link_set_netns"
+	StepAddrAdd       = "addr_add"
+	StepRouteAdd      = "route_add"
+	StepBridgeAdd     = "bridge_add"
+	StepBridgePortAdd = "bridge_port_add"
+	StepServiceStart  = "service_start"
+)
+
+// Step is a change made to the kernel, which is recorded so that it can be undone.
+type Step struct {
+	Op   string   `json:"op"`
+	Args []string `json:"args"`
+}
+
+func (s Step) String() string {
+	return s.Op + " " + strings.Join(s.Args, " ")
+}
+
+// Recorder persists the steps before they happen.
+type Recorder interface {
+	Record(step Step) error
+	// Discard forgets the recorded step, since the change has failed.
+	Discard(step Step) error
+}
+
+// WithRecorder returns the context whose changes are recorded by r. nil stops recording.
+func WithRecorder(ctx context.Context, r Recorder) context.Context {
+	return withSettings(ctx, func(s *settings) { s.recorder = r })
+}
+
+// change records the step, then makes the change by fn. The step is recorded first, so that
+// the change is undone even if ayame crashes in the middle. It is discarded if the change
+// has failed, but kept if ctx is done, since the change may have been made.
+func change(ctx context.Context, step Step, fn func() error) error {
+	r := settingsFrom(ctx).recorder
+	if r == nil {
+		return fn()
+	}
+
+	if err := r.Record(step); err != nil {
+		return fmt.Errorf("failed to record %s: %s", step.String(), err)
+	}
+
+	err := fn()
+	if err != nil && ctx.Err() == nil {
+		if derr := r.Discard(step); derr != nil {
+			log.Warnf("failed to discard %s: %s", step.String(), derr)
+		}
+	}
+	return err
+}
+
+// UndoStep reverts the change. Resources which have already gone, or haven't been made
+// since ayame crashed before the change, are skipped, so that it can be run again.
+func UndoStep(ctx context.Context, step Step) error {
+	arg := func(i int) string {
+		if i < len(step.Args) {
+			return step.Args[i]
+		}
+		return ""
+	}
+
+	switch step.Op {
+	case StepNetnsAdd:
+		if !IsDryRun(ctx) && !CheckIpNetnsExists(ctx, arg(0)) {
+			return nil
+		}
+		return RunIpNetnsDelete(ctx, arg(0))
+	case StepVethAdd:
+		// The veth is deleted together with the namespace if it has been moved.
+		if !IsDryRun(ctx) && !linkExists(ctx, arg(0), "") {
+			return nil
+		}
+		return RunIpLinkDelete(ctx, arg(0))
+	case StepLinkSetNetns:
+		if !IsDryRun(ctx) && !linkExists(ctx, arg(0), arg(1)) {
+			return nil
+		}
+		return RunIpLinkDeleteInNamespace(ctx, arg(0), arg(1))
+	case StepAddrAdd:
+		if !IsDryRun(ctx) && (!linkExists(ctx, arg(0), arg(1)) || !addrExists(ctx, arg(0), arg(1), arg(2))) {
+			return nil
+		}
+		return RunDeleteCidrFromNamespaces(ctx, arg(0), arg(1), arg(2))
+	case StepRouteAdd:
+		if !IsDryRun(ctx) && (!CheckIpNetnsExists(ctx, arg(0)) || (arg(3) != "" && !linkExists(ctx, arg(3), arg(0))) ||
+			!routeExists(ctx, arg(0), arg(1), arg(2))) {
+			return nil
+		}
+		return RunIpRoute(ctx, "del", arg(0), arg(1), arg(2), arg(3))
+	case StepBridgeAdd:
+		return DeleteBridge(ctx, arg(0))
+	case StepBridgePortAdd:
+		return UnlinkBridge(ctx, arg(0), &Veth{Name: arg(1)})
+	case StepServiceStart:
+		pid, err := strconv.Atoi(arg(1))
+		if err != nil {
+			return fmt.Errorf("invalid pid %s", arg(1))
+		}
+		// The PID is unknown when the step is recorded, so the supervisor is found by its log.
+		if pid == 0 && !IsHermetic(ctx) {
+			pid = findSupervisor(arg(2))
+		}
+		svc := &Service{Name: arg(0), PID: pid, LogPath: arg(2)}
+		return svc.Stop(ctx)
+	}
+
+	return fmt.Errorf("unknown step %s", step.Op)
+}
+
+// linkExists reports whether the interface exists in the namespace, or on the host if nsname is empty.
+func linkExists(ctx context.Context, ifname string, nsname string) bool {
+	exists, err := backendFor(ctx).linkExists(ctx, ifname, nsname)
+	if err != nil {
+		log.Warnf("failed to check %s: %s", ifname, err)
+		return false
+	}
+	return exists
+}
+
+// addrExists reports whether the address is assigned to the interface in the namespace.
+func addrExists(ctx context.Context, ifname string, nsname string, cidr string) bool {
+	links, err := ListLinks(ctx, nsname)
+	if err != nil {
+		log.Warnf("failed to check %s: %s", ifname, err)
+		return false
+	}
+
+	for _, c := range links[ifname].Cidrs {
+		if c == cidr {
+			return true
+		}
+	}
+	return false
+}
+
+// routeExists reports whether the route to the destination is in the namespace.
+func routeExists(ctx context.Context, nsname string, to string, via string) bool {
+	routes, err := ListRoutes(ctx, nsname)
+	if err != nil {
+		log.Warnf("failed to check route %s: %s", to, err)
+		return false
+	}
+
+	to = NormalizeRouteDestination(to)
+	for _, r := range routes {
+		if r.To == to && (via == "" || r.Via == via) {
+			return true
+		}
+	}
+	return false
+}
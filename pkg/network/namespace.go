@@ -15,11 +15,9 @@
 package network
 
 import (
+	"context"
 	"fmt"
 	"net"
-	"os/exec"
-	"regexp"
-	"strings"
 
 	"github.com/Shikugawa/ayame/pkg/config"
 	log "github.com/sirupsen/logrus"
@@ -31,12 +29,27 @@ type RegisteredDeviceConfig struct {
 	AttachedVeth                 string `json:"attached_veth"`
 }
 
+// NetnsPrefix is prepended to the names of network namespaces created by ayame, so that
+// orphaned ones can be found by `ayame gc`.
+const NetnsPrefix = "ayame-"
+
 type Namespace struct {
-	Name                   string                   `json:"name"`
+	Name string `json:"name"`
+	// Netns is the name of the network namespace in the kernel.
+	Netns                  string                   `json:"netns,omitempty"`
 	RegisteredDeviceConfig []RegisteredDeviceConfig `json:"registered_device_config"`
+	// Commands are kept to run them again when the namespace is restored.
+	Commands       []config.CommandConfig `json:"commands,omitempty"`
+	CommandResults []CommandResult        `json:"command_results,omitempty"`
+	OnDelete       []config.CommandConfig `json:"on_delete,omitempty"`
+	Services       []*Service             `json:"services,omitempty"`
+	Routes         []config.RouteConfig   `json:"routes,omitempty"`
+	// DependsOn and ReadyWhen are kept to start the namespaces in the same order when they are restored.
+	DependsOn []string             `json:"depends_on,omitempty"`
+	ReadyWhen []config.ProbeConfig `json:"ready_when,omitempty"`
 }
 
-func InitNamespace(config *config.NamespaceConfig, dryrun bool) (*Namespace, error) {
+func InitNamespace(ctx context.Context, config *config.NamespaceConfig, lab string) (*Namespace, error) {
 	var configs []RegisteredDeviceConfig
 	for _, c := range config.Devices {
 		tmp := RegisteredDeviceConfig{
@@ -48,10 +61,14 @@ func InitNamespace(config *config.NamespaceConfig, dryrun bool) (*Namespace, err
 
 	ns := &Namespace{
 		Name:                   config.Name,
+		Netns:                  LabNetns(lab, config.Name),
 		RegisteredDeviceConfig: configs,
+		OnDelete:               config.OnDelete,
+		DependsOn:              config.DependsOn,
+		ReadyWhen:              config.ReadyWhen,
 	}
 
-	if err := RunIpNetnsAdd(config.Name, dryrun); err != nil {
+	if err := RunIpNetnsAdd(ctx, ns.Netns); err != nil {
 		return nil, err
 	}
 
@@ -59,14 +76,18 @@ func InitNamespace(config *config.NamespaceConfig, dryrun bool) (*Namespace, err
 	return ns, nil
 }
 
-func (n *Namespace) Destroy(dryrun bool) error {
+func (n *Namespace) Destroy(ctx context.Context) error {
+	if err := n.StopServices(ctx); err != nil {
+		log.Warnf(err.Error())
+	}
+
 	// namespaces don't exist anymore after host shutted down. Here ignores the closed netns.
-	if !CheckIpNetnsExists(n.Name, dryrun) {
+	if !CheckIpNetnsExists(ctx, n.NetnsName()) {
 		log.Infof("%s doesn't exist\n", n.Name)
 		return nil
 	}
 
-	if err := RunIpNetnsDelete(n.Name, dryrun); err != nil {
+	if err := RunIpNetnsDelete(ctx, n.NetnsName()); err != nil {
 		return err
 	}
 
@@ -74,14 +95,158 @@ func (n *Namespace) Destroy(dryrun bool) error {
 	return nil
 }
 
-func (n *Namespace) Attach(veth *Veth, dryrun bool) error {
+// NetnsName returns the name of the network namespace in the kernel.
+func (n *Namespace) NetnsName() string {
+	return n.Netns
+}
+
+// HasAttached reports whether the veth is attached to the namespace.
+func (n *Namespace) HasAttached(veth string) bool {
+	for _, dev := range n.RegisteredDeviceConfig {
+		if dev.AttachedVeth == veth {
+			return true
+		}
+	}
+	return false
+}
+
+// Register adds the device to be attached later.
+func (n *Namespace) Register(dev config.NamespaceDeviceConfig) {
+	n.RegisteredDeviceConfig = append(n.RegisteredDeviceConfig, RegisteredDeviceConfig{NamespaceDeviceConfig: dev})
+}
+
+// Detach forgets the device whose veth has been deleted.
+func (n *Namespace) Detach(device string) {
+	var configs []RegisteredDeviceConfig
+	for _, dev := range n.RegisteredDeviceConfig {
+		if dev.Name != device {
+			configs = append(configs, dev)
+		}
+	}
+	n.RegisteredDeviceConfig = configs
+}
+
+// Release moves the attached veth back to the host, keeping the device registered.
+func (n *Namespace) Release(ctx context.Context, device string, veth *Veth) error {
+	if !veth.Attached {
+		return nil
+	}
+
+	if err := RunIpLinkSetHost(ctx, veth.Name, n.NetnsName()); err != nil {
+		return err
+	}
+
+	for i, dev := range n.RegisteredDeviceConfig {
+		if dev.Name == device && dev.AttachedVeth == veth.Name {
+			n.RegisteredDeviceConfig[i].AttachedVeth = ""
+		}
+	}
+	veth.Attached = false
+	return nil
+}
+
+// ChangeCidr replaces the address of the attached device.
+func (n *Namespace) ChangeCidr(ctx context.Context, device string, cidr string) error {
+	for i, dev := range n.RegisteredDeviceConfig {
+		if dev.Name != device || len(dev.AttachedVeth) == 0 {
+			continue
+		}
+
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("failed to parse CIDR %s in namespace %s device %s: %s", cidr, n.Name, device, err)
+		}
+
+		if err := RunDeleteCidrFromNamespaces(ctx, dev.AttachedVeth, n.NetnsName(), dev.Cidr); err != nil {
+			return err
+		}
+		if err := RunAssignCidrToNamespaces(ctx, dev.AttachedVeth, n.NetnsName(), cidr); err != nil {
+			return err
+		}
+
+		n.RegisteredDeviceConfig[i].Cidr = cidr
+		return nil
+	}
+
+	return fmt.Errorf("device %s is not attached to %s", device, n.Name)
+}
+
+// AddRoute adds the route inside the namespace, and records it.
+func (n *Namespace) AddRoute(ctx context.Context, route config.RouteConfig) error {
+	ifname, err := n.routeIfname(route)
+	if err != nil {
+		return err
+	}
+
+	if err := RunIpRoute(ctx, "add", n.NetnsName(), route.To, route.Via, ifname); err != nil {
+		return err
+	}
+
+	n.Routes = append(n.Routes, route)
+	return nil
+}
+
+// DeleteRoute deletes the recorded route from the namespace.
+func (n *Namespace) DeleteRoute(ctx context.Context, route config.RouteConfig) error {
+	ifname, err := n.routeIfname(route)
+	if err != nil {
+		return err
+	}
+
+	if err := RunIpRoute(ctx, "del", n.NetnsName(), route.To, route.Via, ifname); err != nil {
+		return err
+	}
+
+	var routes []config.RouteConfig
+	for _, r := range n.Routes {
+		if r != route {
+			routes = append(routes, r)
+		}
+	}
+	n.Routes = routes
+	return nil
+}
+
+func (n *Namespace) routeIfname(route config.RouteConfig) (string, error) {
+	if route.Device == "" {
+		return "", nil
+	}
+	return n.DeviceIfname(route.Device)
+}
+
+// Addresses returns the addresses assigned to the devices.
+func (n *Namespace) Addresses() []net.IP {
+	var addrs []net.IP
+	for _, dev := range n.RegisteredDeviceConfig {
+		ip, _, err := net.ParseCIDR(dev.Cidr)
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, ip)
+	}
+	return addrs
+}
+
+// SharesLinkWith reports whether both namespaces are attached to the same link.
+func (n *Namespace) SharesLinkWith(other *Namespace) bool {
+	for _, dev := range n.RegisteredDeviceConfig {
+		for _, otherDev := range other.RegisteredDeviceConfig {
+			if dev.Name == otherDev.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Attach moves the veth of the link into the namespace, and assigns the address of the device.
+func (n *Namespace) Attach(ctx context.Context, device string, veth *Veth) error {
 	if veth.Attached {
 		return fmt.Errorf("device %s is already attached", veth.Name)
 	}
 
 	targetCfgIdx := -1
 	for idx, config := range n.RegisteredDeviceConfig {
-		if !strings.HasPrefix(veth.Name, config.Name) {
+		if config.Name != device {
 			continue
 		}
 
@@ -105,11 +270,11 @@ func (n *Namespace) Attach(veth *Veth, dryrun bool) error {
 			targetCfg.Cidr, n.Name, targetCfg.Name, err)
 	}
 
-	if err := RunIpLinkSetNamespaces(veth.Name, n.Name, dryrun); err != nil {
+	if err := RunIpLinkSetNamespaces(ctx, veth.Name, n.NetnsName()); err != nil {
 		return fmt.Errorf("failed to set device %s in namespace %s: %s", targetCfg.Name, n.Name, err)
 	}
 
-	if err := RunAssignCidrToNamespaces(veth.Name, n.Name, targetCfg.Cidr, dryrun); err != nil {
+	if err := RunAssignCidrToNamespaces(ctx, veth.Name, n.NetnsName(), targetCfg.Cidr); err != nil {
 		return fmt.Errorf("failed to assign CIDR %s to ns %s on %s", targetCfg.Cidr, n.Name, veth.Name)
 	}
 
@@ -120,141 +285,95 @@ func (n *Namespace) Attach(veth *Veth, dryrun bool) error {
 	return nil
 }
 
-func (n *Namespace) RunCommands(commands []string, dryrun bool) {
-	for _, command := range commands {
-		netnsCmd, err := n.buildCommand(command)
-		if err != nil {
-			log.Warn(err.Error())
-			continue
-		}
-		name := netnsCmd[0]
-		rest := netnsCmd[1:]
-		cmd := exec.Command(name, rest...)
-		log.Infof("execute %s", cmd.String())
-
-		if dryrun {
-			continue
-		}
-		res, err := cmd.Output()
-		if err != nil {
-			log.Warn(err.Error())
-			continue
-		}
-
-		log.Infof("\n%s", string(res))
+// RunCommands runs the commands inside the namespace, and records their results.
+// With PolicyAbort it returns the first error, otherwise it runs all the commands and
+// returns the errors together.
+func (n *Namespace) RunCommands(ctx context.Context, commands []config.CommandConfig, peers []*Namespace,
+	policy config.CommandFailurePolicy) error {
+	build := func(command config.CommandConfig) ([]string, error) {
+		return n.buildCommand(ctx, command, peers)
 	}
+
+	results, err := runCommands(ctx, commands, build, n.Name, policy)
+	n.Commands = append(n.Commands, commands...)
+	n.CommandResults = append(n.CommandResults, results...)
+	return err
 }
 
-func (n *Namespace) buildCommand(command string) ([]string, error) {
-	splited := strings.Split(command, " ")
-	if len(splited) == 0 {
-		return nil, fmt.Errorf("malformed command: %s", command)
+// RunOnDeleteCommands runs on_delete commands before the namespace is deleted.
+// Failures are only logged not to block the teardown.
+func (n *Namespace) RunOnDeleteCommands(ctx context.Context, peers []*Namespace) {
+	if len(n.OnDelete) == 0 {
+		return
 	}
 
-	netnsCmd := []string{}
-	netnsCmd = append(netnsCmd, "ip")
-	netnsCmd = append(netnsCmd, "netns")
-	netnsCmd = append(netnsCmd, "exec")
-	netnsCmd = append(netnsCmd, n.Name)
-
-	re := regexp.MustCompile(`[0-9a-zA-Z]*`)
-
-	for _, s := range splited {
-		newCmd := s
-		if res, err := regexp.MatchString(`\$\(.*\)`, newCmd); res && err == nil {
-			devName := re.FindString(newCmd)
-			for _, dev := range n.RegisteredDeviceConfig {
-				if len(dev.AttachedVeth) != 0 && strings.HasPrefix(dev.Name, devName) {
-					newCmd = dev.AttachedVeth
-				}
-			}
-		}
-
-		netnsCmd = append(netnsCmd, newCmd)
+	build := func(command config.CommandConfig) ([]string, error) {
+		return n.buildCommand(ctx, command, peers)
 	}
 
-	return netnsCmd, nil
+	if _, err := runCommands(ctx, n.OnDelete, build, n.Name, config.PolicyContinue); err != nil {
+		log.Warnf("some on_delete commands failed in %s", n.Name)
+	}
 }
 
-func InitNamespaces(conf []*config.NamespaceConfig, dryrun bool) ([]*Namespace, error) {
-	var namespaces []*Namespace
+func (n *Namespace) buildCommand(ctx context.Context, command config.CommandConfig, peers []*Namespace) ([]string, error) {
+	expanded, err := n.ExpandVariables(command.Command, peers)
+	if err != nil {
+		return nil, err
+	}
 
-	// Setup namespaces
-	for _, c := range conf {
-		ns, err := InitNamespace(c, dryrun)
-		if err != nil {
-			return nil, err
-		}
+	if command.Shell {
+		return backendFor(ctx).execArgs(n.NetnsName(), []string{"sh", "-c", expanded})
+	}
 
-		namespaces = append(namespaces, ns)
+	words, err := splitCommand(expanded)
+	if err != nil {
+		return nil, err
 	}
 
-	return namespaces, nil
+	return backendFor(ctx).execArgs(n.NetnsName(), words)
 }
 
-func InitNamespacesLinks(namespaces []*Namespace, links map[string]*DirectLink, dryrun bool) error {
-	netLinks := make(map[string][]int)
-
-	for i, ns := range namespaces {
-		for _, devConf := range ns.RegisteredDeviceConfig {
-			if len(devConf.AttachedVeth) != 0 {
-				continue
-			}
-
-			if _, ok := links[devConf.Name]; !ok {
-				continue
-			}
-
-			if _, ok := netLinks[devConf.Name]; !ok {
-				netLinks[devConf.Name] = []int{}
-			}
-			netLinks[devConf.Name] = append(netLinks[devConf.Name], i)
-		}
+// Exec runs the command inside the namespace and returns its result.
+func (n *Namespace) Exec(ctx context.Context, command config.CommandConfig, peers []*Namespace) (*CommandResult, error) {
+	build := func(command config.CommandConfig) ([]string, error) {
+		return n.buildCommand(ctx, command, peers)
 	}
 
-	for linkName, idxs := range netLinks {
-		if len(idxs) != 2 {
-			return fmt.Errorf("%s should have only 2 link in %s\n", linkName, namespaces[idxs[0]].Name)
-		}
+	return runCommand(ctx, command, build, n.Name)
+}
 
-		targetLink, ok := links[linkName]
-		if !ok {
-			return fmt.Errorf("can't find device %s in configured links", linkName)
-		}
+// DeviceIfname returns the name of the veth attached for the device.
+func (n *Namespace) DeviceIfname(device string) (string, error) {
+	return n.resolveDeviceVariable(device, "ifname")
+}
 
-		if err := targetLink.CreateLink(namespaces[idxs[0]], namespaces[idxs[1]], dryrun); err != nil {
-			return fmt.Errorf("failed to create links %s: %s", linkName, err.Error())
+// BuildExecCommand builds the command which runs args inside the namespace.
+// Variables in args are expanded in the same way as commands in the config.
+func (n *Namespace) BuildExecCommand(ctx context.Context, args []string, peers []*Namespace) ([]string, error) {
+	var expanded []string
+	for _, arg := range args {
+		e, err := n.ExpandVariables(arg, peers)
+		if err != nil {
+			return nil, err
 		}
+		expanded = append(expanded, e)
 	}
 
-	return nil
+	return backendFor(ctx).execArgs(n.NetnsName(), expanded)
 }
 
-func InitNamespacesBridges(namespaces []*Namespace, bridges map[string]*Bridge, dryrun bool) error {
-	for _, ns := range namespaces {
-		for _, dev := range ns.RegisteredDeviceConfig {
-			if len(dev.AttachedVeth) != 0 {
-				continue
-			}
-
-			targetLink, ok := bridges[dev.Name]
-			if !ok {
-				continue
-			}
-
-			if err := targetLink.CreateLink(ns, dryrun); err != nil {
-				return fmt.Errorf("failed to link %s to bridge %s", ns.Name, targetLink.Name)
-			}
-		}
+// RunNamespacesOnDeleteCommands runs on_delete commands of all the namespaces.
+func RunNamespacesOnDeleteCommands(ctx context.Context, nss []*Namespace) {
+	for _, n := range nss {
+		n.RunOnDeleteCommands(ctx, nss)
 	}
-
-	return nil
 }
 
-func CleanupNamespaces(nss []*Namespace, dryrun bool) error {
+func CleanupNamespaces(ctx context.Context, nss []*Namespace) error {
 	var allerr error
 	for _, n := range nss {
-		if err := n.Destroy(dryrun); err != nil {
+		if err := n.Destroy(ctx); err != nil {
 			allerr = multierr.Append(allerr, err)
 		}
 	}
@@ -0,0 +1,65 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// maxIfnameLen is IFNAMSIZ without the terminating null.
+const maxIfnameLen = 15
+
+// LabNetns returns the name of the network namespace in the lab.
+func LabNetns(lab string, name string) string {
+	if lab == "" {
+		return NetnsPrefix + name
+	}
+	return NetnsPrefix + lab + "-" + name
+}
+
+// LabIfname returns the interface name which doesn't collide with the other labs.
+// The name is prefixed with a hash of the lab, and replaced with its hash if it is too long.
+func LabIfname(lab string, name string) string {
+	if lab == "" {
+		return name
+	}
+
+	prefix := LabPrefix(lab)
+	if ifname := prefix + "-" + name; len(ifname) <= maxIfnameLen {
+		return ifname
+	}
+	return fmt.Sprintf("%s-%08x", prefix, hash(name))
+}
+
+// LabPrefix returns the prefix of the interface names in the lab. Labs can share the
+// prefix since it is short, so a new lab must not use the prefix of the existing ones.
+func LabPrefix(lab string) string {
+	return fmt.Sprintf("%04x", hash(lab)&0xffff)
+}
+
+// vethNames returns the names of the both ends of the veth. They keep the names
+// without the lab, since only the prefixed ones need to be short.
+func vethNames(lab string, name string) (string, string) {
+	if lab == "" {
+		return name + "-left", name + "-right"
+	}
+	return LabIfname(lab, name+"-l"), LabIfname(lab, name+"-r")
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,503 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkBackend talks to the kernel with netlink instead of running iproute2.
+// Namespaces are bind mounted under /var/run/netns in the same way as `ip netns add`.
+type netlinkBackend struct{}
+
+func netnsPath(name string) string {
+	return filepath.Join(netnsRunDir, name)
+}
+
+func (b *netlinkBackend) addNetns(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	log.Infof("netlink: add netns %s", name)
+
+	if err := os.MkdirAll(netnsRunDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %s", netnsRunDir, err)
+	}
+
+	// Mounts under the directory must be shared with the other mount namespaces.
+	if err := unix.Mount("", netnsRunDir, "none", unix.MS_SHARED|unix.MS_REC, ""); err != nil {
+		if err != unix.EINVAL {
+			return fmt.Errorf("failed to share %s: %s", netnsRunDir, err)
+		}
+		// The directory isn't a mount point yet.
+		if err := unix.Mount(netnsRunDir, netnsRunDir, "none", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind mount %s: %s", netnsRunDir, err)
+		}
+		if err := unix.Mount("", netnsRunDir, "none", unix.MS_SHARED|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to share %s: %s", netnsRunDir, err)
+		}
+	}
+
+	path := netnsPath(name)
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %s", path, err)
+	}
+	f.Close()
+
+	err = doInThread(func() error {
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			return fmt.Errorf("failed to unshare netns: %s", err)
+		}
+
+		self := fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+		if err := unix.Mount(self, path, "none", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to bind mount %s: %s", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return nil
+}
+
+func (b *netlinkBackend) deleteNetns(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	log.Infof("netlink: delete netns %s", name)
+
+	path := netnsPath(name)
+	if err := unix.Unmount(path, unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount %s: %s", path, err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove %s: %s", path, err)
+	}
+
+	return nil
+}
+
+func (b *netlinkBackend) netnsExists(ctx context.Context, name string) (bool, error) {
+	_, err := os.Stat(netnsPath(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *netlinkBackend) listNetns(ctx context.Context) (map[string]bool, error) {
+	nss := make(map[string]bool)
+
+	files, err := ioutil.ReadDir(netnsRunDir)
+	if os.IsNotExist(err) {
+		// The directory is created on the first namespace.
+		return nss, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		nss[f.Name()] = true
+	}
+	return nss, nil
+}
+
+// handle returns the netlink handle in the namespace, or on the host if nsname is empty.
+func (b *netlinkBackend) handle(ctx context.Context, nsname string) (*netlink.Handle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if nsname == "" {
+		return netlink.NewHandle()
+	}
+
+	ns, err := netns.GetFromPath(netnsPath(nsname))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ns %s: %s", nsname, err)
+	}
+	defer ns.Close()
+
+	return netlink.NewHandleAt(ns)
+}
+
+// link returns the handle and the device in the namespace. The handle must be deleted.
+func (b *netlinkBackend) link(ctx context.Context, ifname string, nsname string) (*netlink.Handle, netlink.Link, error) {
+	h, err := b.handle(ctx, nsname)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l, err := h.LinkByName(ifname)
+	if err != nil {
+		h.Delete()
+		return nil, nil, fmt.Errorf("failed to find device %s: %s", ifname, err)
+	}
+
+	return h, l, nil
+}
+
+func (b *netlinkBackend) addVeth(ctx context.Context, left string, right string) error {
+	h, err := b.handle(ctx, "")
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	log.Infof("netlink: add veth %s peer %s", left, right)
+	return h.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: left}, PeerName: right})
+}
+
+func (b *netlinkBackend) setAlias(ctx context.Context, ifname string, alias string) error {
+	h, l, err := b.link(ctx, ifname, "")
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	log.Infof("netlink: set alias of %s to %s", ifname, alias)
+	return h.LinkSetAlias(l, alias)
+}
+
+func (b *netlinkBackend) deleteLink(ctx context.Context, ifname string, nsname string) error {
+	h, l, err := b.link(ctx, ifname, nsname)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	log.Infof("netlink: delete %s", ifname)
+	return h.LinkDel(l)
+}
+
+func (b *netlinkBackend) linkExists(ctx context.Context, ifname string, nsname string) (bool, error) {
+	if nsname != "" {
+		if exists, err := b.netnsExists(ctx, nsname); !exists {
+			return false, err
+		}
+	}
+
+	h, err := b.handle(ctx, nsname)
+	if err != nil {
+		return false, err
+	}
+	defer h.Delete()
+
+	_, err = h.LinkByName(ifname)
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *netlinkBackend) setNetns(ctx context.Context, ifname string, nsname string) error {
+	h, l, err := b.link(ctx, ifname, "")
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	ns, err := netns.GetFromPath(netnsPath(nsname))
+	if err != nil {
+		return fmt.Errorf("failed to open ns %s: %s", nsname, err)
+	}
+	defer ns.Close()
+
+	log.Infof("netlink: move %s to ns %s", ifname, nsname)
+	return h.LinkSetNsFd(l, int(ns))
+}
+
+func (b *netlinkBackend) setHostNetns(ctx context.Context, ifname string, nsname string) error {
+	h, l, err := b.link(ctx, ifname, nsname)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	host, err := netns.GetFromPid(1)
+	if err != nil {
+		return fmt.Errorf("failed to open the host ns: %s", err)
+	}
+	defer host.Close()
+
+	log.Infof("netlink: move %s in ns %s to host", ifname, nsname)
+	return h.LinkSetNsFd(l, int(host))
+}
+
+func (b *netlinkBackend) setLinkState(ctx context.Context, ifname string, nsname string, up bool) error {
+	h, l, err := b.link(ctx, ifname, nsname)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	log.Infof("netlink: set %s %s in ns %s", ifname, linkState(up), nsname)
+	if up {
+		return h.LinkSetUp(l)
+	}
+	return h.LinkSetDown(l)
+}
+
+func (b *netlinkBackend) addAddr(ctx context.Context, ifname string, nsname string, cidr string) error {
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR %s: %s", cidr, err)
+	}
+
+	h, l, err := b.link(ctx, ifname, nsname)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	log.Infof("netlink: add %s to %s in ns %s", cidr, ifname, nsname)
+	return h.AddrAdd(l, addr)
+}
+
+func (b *netlinkBackend) deleteAddr(ctx context.Context, ifname string, nsname string, cidr string) error {
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR %s: %s", cidr, err)
+	}
+
+	h, l, err := b.link(ctx, ifname, nsname)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	log.Infof("netlink: delete %s from %s in ns %s", cidr, ifname, nsname)
+	return h.AddrDel(l, addr)
+}
+
+func (b *netlinkBackend) route(ctx context.Context, op string, nsname string, to string, via string, ifname string) error {
+	r := &netlink.Route{}
+	if to != "default" {
+		_, dst, err := net.ParseCIDR(to)
+		if err != nil {
+			return fmt.Errorf("invalid destination %s: %s", to, err)
+		}
+		r.Dst = dst
+	}
+	if via != "" {
+		if r.Gw = net.ParseIP(via); r.Gw == nil {
+			return fmt.Errorf("invalid gateway %s", via)
+		}
+	}
+
+	h, err := b.handle(ctx, nsname)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	if ifname != "" {
+		l, err := h.LinkByName(ifname)
+		if err != nil {
+			return fmt.Errorf("failed to find device %s: %s", ifname, err)
+		}
+		r.LinkIndex = l.Attrs().Index
+	}
+
+	log.Infof("netlink: %s route %s in ns %s", op, to, nsname)
+	switch op {
+	case "add":
+		return h.RouteAdd(r)
+	case "del", "delete":
+		return h.RouteDel(r)
+	}
+	return fmt.Errorf("unknown route operation %s", op)
+}
+
+func (b *netlinkBackend) listLinks(ctx context.Context, nsname string) (map[string]LinkInfo, error) {
+	h, err := b.handle(ctx, nsname)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Delete()
+
+	ls, err := h.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %s", err)
+	}
+
+	names := make(map[int]string)
+	for _, l := range ls {
+		names[l.Attrs().Index] = l.Attrs().Name
+	}
+
+	links := make(map[string]LinkInfo)
+	for _, l := range ls {
+		attrs := l.Attrs()
+		link := LinkInfo{Name: attrs.Name, Alias: attrs.Alias, Up: attrs.Flags&net.FlagUp != 0, OperState: attrs.OperState.String()}
+		// The parent in another namespace has the netns id.
+		if attrs.NetNsID < 0 {
+			link.Peer = names[attrs.ParentIndex]
+		}
+
+		addrs, err := h.AddrList(l, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list addresses of %s: %s", attrs.Name, err)
+		}
+		for _, addr := range addrs {
+			link.Cidrs = append(link.Cidrs, addr.IPNet.String())
+		}
+		links[attrs.Name] = link
+	}
+	return links, nil
+}
+
+func (b *netlinkBackend) listRoutes(ctx context.Context, nsname string) ([]RouteInfo, error) {
+	h, err := b.handle(ctx, nsname)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Delete()
+
+	ls, err := h.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %s", err)
+	}
+
+	names := make(map[int]string)
+	for _, l := range ls {
+		names[l.Attrs().Index] = l.Attrs().Name
+	}
+
+	var routes []RouteInfo
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rs, err := h.RouteList(nil, family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list routes: %s", err)
+		}
+
+		for _, r := range rs {
+			route := RouteInfo{To: "default", Device: names[r.LinkIndex]}
+			if r.Dst != nil {
+				route.To = NormalizeRouteDestination(r.Dst.String())
+			}
+			if r.Gw != nil {
+				route.Via = r.Gw.String()
+			}
+			routes = append(routes, route)
+		}
+	}
+	return routes, nil
+}
+
+// setNetem sets netem with the arguments of tc. Only delay, jitter and loss are supported
+// by netlink, so tc is run inside the namespace if the rate is limited.
+func (b *netlinkBackend) setNetem(ctx context.Context, ifname string, nsname string, args []string) error {
+	attrs, err := parseNetemArgs(args)
+	if err == errNetemRate {
+		tcArgs, err := b.execArgs(nsname, []string{"tc", "qdisc", "replace", "dev", ifname, "root", "netem"})
+		if err != nil {
+			return err
+		}
+		return run(ctx, tcArgs[0], append(tcArgs[1:], args...)...)
+	}
+	if err != nil {
+		return err
+	}
+
+	h, l, err := b.link(ctx, ifname, nsname)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	qdisc := netlink.NewNetem(netlink.QdiscAttrs{LinkIndex: l.Attrs().Index, Parent: netlink.HANDLE_ROOT}, attrs)
+	if len(args) == 0 {
+		log.Infof("netlink: delete netem on %s in ns %s", ifname, nsname)
+		return h.QdiscDel(qdisc)
+	}
+
+	log.Infof("netlink: set netem %v on %s in ns %s", args, ifname, nsname)
+	return h.QdiscReplace(qdisc)
+}
+
+var errNetemRate = errors.New("rate isn't supported by netlink")
+
+// parseNetemArgs parses "delay TIME [JITTER]", "loss PERCENT" and "rate RATE" in the arguments of tc.
+func parseNetemArgs(args []string) (netlink.NetemQdiscAttrs, error) {
+	var attrs netlink.NetemQdiscAttrs
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "delay":
+			if i+1 >= len(args) {
+				return attrs, fmt.Errorf("delay needs time")
+			}
+			latency, err := time.ParseDuration(args[i+1])
+			if err != nil {
+				return attrs, fmt.Errorf("invalid delay %s: %s", args[i+1], err)
+			}
+			attrs.Latency = uint32(latency.Microseconds())
+			i++
+
+			if i+1 < len(args) && args[i+1] != "loss" && args[i+1] != "rate" {
+				jitter, err := time.ParseDuration(args[i+1])
+				if err != nil {
+					return attrs, fmt.Errorf("invalid jitter %s: %s", args[i+1], err)
+				}
+				attrs.Jitter = uint32(jitter.Microseconds())
+				i++
+			}
+		case "loss":
+			if i+1 >= len(args) {
+				return attrs, fmt.Errorf("loss needs percentage")
+			}
+			loss, err := strconv.ParseFloat(strings.TrimSuffix(args[i+1], "%"), 32)
+			if err != nil {
+				return attrs, fmt.Errorf("invalid loss %s: %s", args[i+1], err)
+			}
+			attrs.Loss = float32(loss)
+			i++
+		case "rate":
+			return attrs, errNetemRate
+		default:
+			return attrs, fmt.Errorf("unknown netem argument %s", args[i])
+		}
+	}
+	return attrs, nil
+}
+
+// execArgs runs args with the hidden command of ayame, which enters the namespace with setns.
+func (b *netlinkBackend) execArgs(nsname string, args []string) ([]string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{self, NetnsExecCommand, nsname, "--"}, args...), nil
+}
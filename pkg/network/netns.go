@@ -0,0 +1,107 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// netnsRunDir has the namespaces created by `ip netns add` or the netlink backend.
+const netnsRunDir = "/var/run/netns"
+
+// NetnsExecCommand is the subcommand of ayame which runs a command inside the namespace
+// for the netlink backend, like `ip netns exec`.
+const NetnsExecCommand = "netns-exec"
+
+// DoInNamespace runs fn inside the network namespace created by `ip netns add`.
+// Sockets opened in fn keep belonging to the namespace after it returns.
+func DoInNamespace(nsname string, fn func() error) error {
+	return doInThread(func() error {
+		target, err := os.Open(filepath.Join(netnsRunDir, nsname))
+		if err != nil {
+			return fmt.Errorf("failed to open ns %s: %s", nsname, err)
+		}
+		defer target.Close()
+
+		if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			return fmt.Errorf("failed to enter ns %s: %s", nsname, err)
+		}
+
+		return fn()
+	})
+}
+
+// ExecInNamespace replaces ayame with the command running inside the namespace. Unlike
+// `ip netns exec`, /sys and /etc/netns/NAME aren't mounted for the namespace.
+func ExecInNamespace(nsname string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no command to execute in ns %s", nsname)
+	}
+
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+
+	// The namespace belongs to the thread, which becomes the command by exec.
+	runtime.LockOSThread()
+
+	target, err := os.Open(filepath.Join(netnsRunDir, nsname))
+	if err != nil {
+		return fmt.Errorf("failed to open ns %s: %s", nsname, err)
+	}
+	defer target.Close()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("failed to enter ns %s: %s", nsname, err)
+	}
+
+	return unix.Exec(path, args, os.Environ())
+}
+
+// doInThread runs fn on a dedicated OS thread, which fn may move to another network
+// namespace. The thread goes back to the original namespace after fn returns.
+func doInThread(fn func() error) error {
+	errCh := make(chan error, 1)
+
+	go func() {
+		runtime.LockOSThread()
+
+		origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- err
+			return
+		}
+		defer origin.Close()
+
+		fnErr := fn()
+
+		// If the thread can't go back, it is left locked so that the runtime discards it.
+		if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err == nil {
+			runtime.UnlockOSThread()
+		}
+
+		errCh <- fnErr
+	}()
+
+	return <-errCh
+}
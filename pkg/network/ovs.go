@@ -1,52 +1,42 @@
 package network
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
-
-	log "github.com/sirupsen/logrus"
 )
 
-func CreateNewBridge(name string, dryrun bool) error {
-	cmd := exec.Command("ovs-vsctl", "add-br", name)
-
-	log.Infof("execute %s", cmd.String())
-
-	if dryrun {
-		return nil
-	}
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create bridge %s", name)
+func CreateNewBridge(ctx context.Context, name string) error {
+	if err := change(ctx, Step{Op: StepBridgeAdd, Args: []string{name}}, func() error {
+		return run(ctx, "ovs-vsctl", "add-br", name,
+			"--", "set", "bridge", name, "external_ids:"+ResourceTag+"=true")
+	}); err != nil {
+		return fmt.Errorf("failed to create bridge %s: %s", name, err)
 	}
 
 	return nil
 }
 
-func DeleteBridge(name string, dryrun bool) error {
-	cmd := exec.Command("ovs-vsctl", "del-br", name)
-
-	log.Infof("execute %s", cmd.String())
-
-	if dryrun {
-		return nil
-	}
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to delete bridge %s", name)
+func DeleteBridge(ctx context.Context, name string) error {
+	if err := run(ctx, "ovs-vsctl", "--if-exists", "del-br", name); err != nil {
+		return fmt.Errorf("failed to delete bridge %s: %s", name, err)
 	}
 
 	return nil
 }
 
-func LinkBridge(name string, veth *Veth, dryrun bool) error {
-	cmd := exec.Command("ovs-vsctl", "add-port", name, veth.Name)
+func LinkBridge(ctx context.Context, name string, veth *Veth) error {
+	if err := change(ctx, Step{Op: StepBridgePortAdd, Args: []string{name, veth.Name}}, func() error {
+		return run(ctx, "ovs-vsctl", "add-port", name, veth.Name)
+	}); err != nil {
+		return fmt.Errorf("failed link %s to %s: %s", veth.Name, name, err)
+	}
 
-	log.Infof("execute %s", cmd.String())
+	return nil
+}
 
-	if dryrun {
-		return nil
-	}
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed link %s to %s", veth.Name, name)
+func UnlinkBridge(ctx context.Context, name string, veth *Veth) error {
+	if err := run(ctx, "ovs-vsctl", "--if-exists", "del-port", name, veth.Name); err != nil {
+		return fmt.Errorf("failed unlink %s from %s: %s", veth.Name, name, err)
 	}
 
 	return nil
@@ -0,0 +1,106 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// Ping sends an ICMP echo request from inside the namespace and returns the round trip time.
+func Ping(nsname string, dst net.IP, seq int, timeout time.Duration) (time.Duration, error) {
+	network, reqType, replyType := "ip4:icmp", byte(icmpv4EchoRequest), byte(icmpv4EchoReply)
+	if dst.To4() == nil {
+		network, reqType, replyType = "ip6:ipv6-icmp", icmpv6EchoRequest, icmpv6EchoReply
+	}
+
+	var conn net.PacketConn
+	if err := DoInNamespace(nsname, func() error {
+		c, err := net.ListenPacket(network, "")
+		if err != nil {
+			return err
+		}
+		conn = c
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("failed to open ICMP socket in %s: %s", nsname, err)
+	}
+	defer conn.Close()
+
+	id := os.Getpid() & 0xffff
+	msg := make([]byte, 16)
+	msg[0] = reqType
+	binary.BigEndian.PutUint16(msg[4:], uint16(id))
+	binary.BigEndian.PutUint16(msg[6:], uint16(seq))
+	copy(msg[8:], "ayame!!!")
+	// The kernel calculates the checksum of ICMPv6.
+	if dst.To4() != nil {
+		binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	}
+
+	start := time.Now()
+	if err := conn.SetDeadline(start.Add(timeout)); err != nil {
+		return 0, err
+	}
+
+	if _, err := conn.WriteTo(msg, &net.IPAddr{IP: dst}); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return 0, fmt.Errorf("no reply from %s within %s", dst, timeout)
+			}
+			return 0, err
+		}
+
+		// Raw sockets receive all the ICMP messages in the namespace.
+		if n < 8 || buf[0] != replyType || !peer.(*net.IPAddr).IP.Equal(dst) {
+			continue
+		}
+		if binary.BigEndian.Uint16(buf[4:]) != uint16(id) || binary.BigEndian.Uint16(buf[6:]) != uint16(seq) {
+			continue
+		}
+
+		return time.Since(start), nil
+	}
+}
+
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
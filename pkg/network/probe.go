@@ -0,0 +1,129 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultProbeTimeout        = 30 * time.Second
+	defaultProbeAttemptTimeout = time.Second
+	probeInterval              = 500 * time.Millisecond
+)
+
+// WaitReady blocks until all the probes succeed.
+func (n *Namespace) WaitReady(ctx context.Context, probes []config.ProbeConfig, peers []*Namespace) error {
+	for _, probe := range probes {
+		if err := n.waitProbe(ctx, probe, peers); err != nil {
+			return err
+		}
+	}
+
+	if len(probes) != 0 {
+		log.Infof("%s is ready", n.Name)
+	}
+
+	return nil
+}
+
+func (n *Namespace) waitProbe(ctx context.Context, probe config.ProbeConfig, peers []*Namespace) error {
+	timeout := probe.Timeout
+	if timeout == 0 {
+		timeout = defaultProbeTimeout
+	}
+
+	check, desc, err := n.buildProbe(ctx, probe, peers)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("wait for %s in %s", desc, n.Name)
+
+	// Fakes answer only commands, and the others would reach the host.
+	if IsDryRun(ctx) || (IsHermetic(ctx) && probe.Command == "") {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s in %s is not ready after %s: %s", desc, n.Name, timeout, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s in %s is not ready: %s", desc, n.Name, ctx.Err())
+		case <-time.After(probeInterval):
+		}
+	}
+}
+
+func (n *Namespace) buildProbe(ctx context.Context, probe config.ProbeConfig, peers []*Namespace) (func() error, string, error) {
+	attemptTimeout := probe.AttemptTimeout
+	if attemptTimeout == 0 {
+		attemptTimeout = defaultProbeAttemptTimeout
+	}
+
+	switch {
+	case probe.TCP != "":
+		addr, err := n.ExpandVariables(probe.TCP, peers)
+		if err != nil {
+			return nil, "", err
+		}
+
+		check := func() error {
+			return DialTCP(n.NetnsName(), addr, attemptTimeout)
+		}
+		return check, "tcp " + addr, nil
+	case probe.Command != "":
+		args, err := n.buildCommand(ctx, config.CommandConfig{Command: probe.Command}, peers)
+		if err != nil {
+			return nil, "", err
+		}
+
+		check := func() error {
+			result := execCommand(ctx, args, attemptTimeout)
+			if result.Error != "" {
+				return errors.New(result.Error)
+			}
+			if result.ExitCode != 0 {
+				return fmt.Errorf("exited with %d", result.ExitCode)
+			}
+			return nil
+		}
+		return check, "command " + probe.Command, nil
+	case probe.File != "":
+		check := func() error {
+			_, err := os.Stat(probe.File)
+			return err
+		}
+		return check, "file " + probe.File, nil
+	}
+
+	return nil, "", fmt.Errorf("empty probe in %s", n.Name)
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+)
+
+// ErrIndeterminate is returned if the reachability can't be told, e.g. no reply came back
+// to a UDP datagram, which happens both when it was dropped and when the server ignored it.
+var ErrIndeterminate = errors.New("indeterminate")
+
+// CheckReachable checks that ip is reachable from inside the namespace with the protocol.
+func CheckReachable(nsname string, ip net.IP, protocol string, port int, timeout time.Duration) error {
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+
+	switch protocol {
+	case config.ProtocolICMP:
+		_, err := Ping(nsname, ip, 0, timeout)
+		return err
+	case config.ProtocolTCP:
+		return DialTCP(nsname, addr, timeout)
+	case config.ProtocolUDP:
+		return probeUDP(nsname, addr, timeout)
+	}
+
+	return fmt.Errorf("unknown protocol %s", protocol)
+}
+
+// DialTCP checks that a TCP connection can be established from inside the namespace.
+func DialTCP(nsname string, addr string, timeout time.Duration) error {
+	return DoInNamespace(nsname, func() error {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// probeUDP sends a datagram and waits for any reply. Since UDP has no handshake, the
+// address is reachable only if the server replies, and unreachable if ICMP port
+// unreachable comes back. Silence is reported as ErrIndeterminate.
+func probeUDP(nsname string, addr string, timeout time.Duration) error {
+	var conn net.Conn
+	if err := DoInNamespace(nsname, func() error {
+		c, err := net.DialTimeout("udp", addr, timeout)
+		if err != nil {
+			return err
+		}
+		conn = c
+		return nil
+	}); err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	if _, err := conn.Write([]byte("ayame")); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	if _, err := conn.Read(buf); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return fmt.Errorf("%w: no reply from %s", ErrIndeterminate, addr)
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return fmt.Errorf("port unreachable: %s", addr)
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+// Restore creates the network namespace again if it has gone, e.g. after reboot.
+// It reports whether the namespace has been created.
+func (n *Namespace) Restore(ctx context.Context) (bool, error) {
+	if CheckIpNetnsExists(ctx, n.NetnsName()) {
+		log.Infof("ns %s exists", n.Name)
+		return false, nil
+	}
+
+	if err := RunIpNetnsAdd(ctx, n.NetnsName()); err != nil {
+		return false, err
+	}
+
+	log.Infof("succeeded to restore ns %s", n.Name)
+	return true, nil
+}
+
+// reattach moves the veth recorded in the namespace into it again, and assigns the address of the device.
+func (n *Namespace) reattach(ctx context.Context, veth string) error {
+	for _, dev := range n.RegisteredDeviceConfig {
+		if dev.AttachedVeth != veth {
+			continue
+		}
+
+		if err := RunIpLinkSetNamespaces(ctx, veth, n.NetnsName()); err != nil {
+			return fmt.Errorf("failed to set device %s in namespace %s: %s", dev.Name, n.Name, err)
+		}
+		return RunAssignCidrToNamespaces(ctx, veth, n.NetnsName(), dev.Cidr)
+	}
+
+	return fmt.Errorf("device %s is not attached to %s", veth, n.Name)
+}
+
+// Restart runs the recorded commands and adds the routes again in the restored namespace.
+// Failed commands don't stop the others.
+func (n *Namespace) Restart(ctx context.Context, peers []*Namespace) error {
+	build := func(command config.CommandConfig) ([]string, error) {
+		return n.buildCommand(ctx, command, peers)
+	}
+
+	results, allerr := runCommands(ctx, n.Commands, build, n.Name, config.PolicyContinue)
+	n.CommandResults = results
+
+	for _, route := range n.Routes {
+		ifname, err := n.routeIfname(route)
+		if err == nil {
+			err = RunIpRoute(ctx, "add", n.NetnsName(), route.To, route.Via, ifname)
+		}
+		if err != nil {
+			allerr = multierr.Append(allerr, err)
+		}
+	}
+
+	return allerr
+}
+
+// RestartServices starts the services which aren't running with the same logs.
+func (n *Namespace) RestartServices(ctx context.Context, peers []*Namespace) error {
+	var allerr error
+	for _, svc := range n.Services {
+		if !IsHermetic(ctx) {
+			if svc.Running() {
+				log.Infof("service %s in %s is running", svc.Name, n.Name)
+				continue
+			}
+
+			if err := os.MkdirAll(filepath.Dir(svc.LogPath), 0755); err != nil {
+				allerr = multierr.Append(allerr, fmt.Errorf("failed to create %s: %s", filepath.Dir(svc.LogPath), err))
+				continue
+			}
+		}
+
+		if err := svc.start(ctx, n, peers); err != nil {
+			allerr = multierr.Append(allerr, err)
+		}
+	}
+	return allerr
+}
+
+// owner returns the namespace which the veth is attached to, or nil if it is on the host.
+func (v *Veth) owner(namespaces []*Namespace) *Namespace {
+	for _, ns := range namespaces {
+		if ns.HasAttached(v.Name) {
+			return ns
+		}
+	}
+	return nil
+}
+
+func (v *Veth) exists(ctx context.Context, namespaces []*Namespace) bool {
+	if ns := v.owner(namespaces); ns != nil {
+		return linkExists(ctx, v.Name, ns.NetnsName())
+	}
+	return linkExists(ctx, v.Name, "")
+}
+
+func (v *Veth) delete(ctx context.Context, namespaces []*Namespace) error {
+	if ns := v.owner(namespaces); ns != nil {
+		return RunIpLinkDeleteInNamespace(ctx, v.Name, ns.NetnsName())
+	}
+	return RunIpLinkDelete(ctx, v.Name)
+}
+
+// restore creates the veth pair again unless both ends are where they were, and moves its
+// ends into the namespaces. It reports whether the pair has been created.
+func (v *VethPair) restore(ctx context.Context, namespaces []*Namespace) (bool, error) {
+	var err error
+	left, right := v.Left.exists(ctx, namespaces), v.Right.exists(ctx, namespaces)
+	if left && right {
+		log.Infof("veth-pair %s@%s exists", v.Left.Name, v.Right.Name)
+		return false, nil
+	}
+
+	// The end left alone is deleted, so that the names are free for the new pair.
+	switch {
+	case left:
+		err = v.Left.delete(ctx, namespaces)
+	case right:
+		err = v.Right.delete(ctx, namespaces)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := v.Create(ctx); err != nil {
+		return false, err
+	}
+
+	for _, end := range []Veth{v.Left, v.Right} {
+		if ns := end.owner(namespaces); ns != nil {
+			if err := ns.reattach(ctx, end.Name); err != nil {
+				return true, err
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// Restore creates the veth pair of the link again if it has gone.
+func (d *DirectLink) Restore(ctx context.Context, namespaces []*Namespace) error {
+	if _, err := d.VethPair.restore(ctx, namespaces); err != nil {
+		return fmt.Errorf("failed to restore link %s: %s", d.Name, err)
+	}
+	return nil
+}
+
+// Restore creates the bridge and its veth pairs again if they have gone. Ports of the
+// veths which have gone are added again, since OpenvSwitch keeps them across reboots.
+func (d *Bridge) Restore(ctx context.Context, namespaces []*Namespace) error {
+	exists, err := BridgeExists(ctx, d.OvsName())
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := CreateNewBridge(ctx, d.OvsName()); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range d.VethPairs {
+		created, err := p.restore(ctx, namespaces)
+		if err != nil {
+			return fmt.Errorf("failed to restore bridge %s: %s", d.Name, err)
+		}
+		if !created {
+			continue
+		}
+
+		if err := UnlinkBridge(ctx, d.OvsName(), &p.Right); err != nil {
+			return err
+		}
+		if err := LinkBridge(ctx, d.OvsName(), &p.Right); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
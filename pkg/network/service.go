@@ -0,0 +1,279 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+const (
+	ServiceRunning = "running"
+	ServiceExited  = "exited"
+
+	// SuperviseCommand is the hidden subcommand of ayame which supervises a service.
+	SuperviseCommand = "supervise"
+
+	serviceStopTimeout = 10 * time.Second
+	restartInterval    = time.Second
+)
+
+// Service is a long-running process inside the namespace. It is supervised by
+// a detached ayame process whose PID is recorded here.
+type Service struct {
+	Name    string               `json:"name"`
+	Command string               `json:"command"`
+	Shell   bool                 `json:"shell,omitempty"`
+	Restart config.RestartPolicy `json:"restart"`
+	PID     int                  `json:"pid"`
+	LogPath string               `json:"log_path"`
+	// Status is filled only when the state is inspected.
+	Status string `json:"status,omitempty"`
+}
+
+// StartServices starts the services detached from ayame itself.
+func (n *Namespace) StartServices(ctx context.Context, configs []config.ServiceConfig, peers []*Namespace, logDir string) error {
+	if len(configs) == 0 {
+		return nil
+	}
+
+	if !IsHermetic(ctx) {
+		if err := os.MkdirAll(logDir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %s", logDir, err)
+		}
+	}
+
+	for _, c := range configs {
+		restart := c.Restart
+		if restart == "" {
+			restart = config.RestartNever
+		}
+
+		svc := &Service{
+			Name:    c.Name,
+			Command: c.Command,
+			Shell:   c.Shell,
+			Restart: restart,
+			LogPath: filepath.Join(logDir, n.Name+"-"+c.Name+".log"),
+		}
+
+		if err := svc.start(ctx, n, peers); err != nil {
+			return err
+		}
+
+		n.Services = append(n.Services, svc)
+	}
+
+	return nil
+}
+
+// StopServices stops all the services in the namespace.
+func (n *Namespace) StopServices(ctx context.Context) error {
+	var allerr error
+	for _, svc := range n.Services {
+		if err := svc.Stop(ctx); err != nil {
+			allerr = multierr.Append(allerr, err)
+		}
+	}
+	return allerr
+}
+
+// RefreshServices fills the current status of the services.
+func (n *Namespace) RefreshServices() {
+	for _, svc := range n.Services {
+		if svc.Running() {
+			svc.Status = ServiceRunning
+		} else {
+			svc.Status = ServiceExited
+		}
+	}
+}
+
+func (s *Service) start(ctx context.Context, ns *Namespace, peers []*Namespace) error {
+	args, err := ns.buildCommand(ctx, config.CommandConfig{Command: s.Command, Shell: s.Shell}, peers)
+	if err != nil {
+		return fmt.Errorf("failed to start service %s in %s: %s", s.Name, ns.Name, err)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to start service %s in %s: %s", s.Name, ns.Name, err)
+	}
+
+	superviseArgs := []string{SuperviseCommand, "--log", s.LogPath, "--restart", string(s.Restart), "--"}
+	cmd := &Command{Name: self, Args: append(superviseArgs, args...)}
+	log.Infof("execute %s", cmd.String())
+
+	// The service isn't bound to ctx, since it outlives ayame.
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to start service %s in %s: %s", s.Name, ns.Name, err)
+	}
+	var pid int
+	step := Step{Op: StepServiceStart, Args: []string{s.Name, "0", s.LogPath}}
+	if err := change(ctx, step, func() error {
+		pid, err = ExecutorFrom(ctx).Start(cmd)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to start service %s in %s: %s", s.Name, ns.Name, err)
+	}
+
+	if IsDryRun(ctx) {
+		return nil
+	}
+
+	s.PID = pid
+
+	log.Infof("succeeded to start service %s in %s with pid %d", s.Name, ns.Name, s.PID)
+	return nil
+}
+
+// findSupervisor returns the PID of the supervisor writing the log, or 0 if it isn't running.
+func findSupervisor(logPath string) int {
+	files, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+
+	for _, f := range files {
+		pid, err := strconv.Atoi(f.Name())
+		if err != nil {
+			continue
+		}
+		if svc := (&Service{PID: pid, LogPath: logPath}); svc.Running() {
+			return pid
+		}
+	}
+	return 0
+}
+
+// Running checks that the recorded PID is still our supervisor, since the PID
+// may be reused by another process after reboot.
+func (s *Service) Running() bool {
+	if s.PID == 0 {
+		return false
+	}
+
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", s.PID))
+	if err != nil {
+		return false
+	}
+
+	return strings.Contains(string(cmdline), s.LogPath)
+}
+
+func (s *Service) Stop(ctx context.Context) error {
+	log.Infof("stop service %s (pid %d)", s.Name, s.PID)
+
+	if IsHermetic(ctx) {
+		return nil
+	}
+
+	if !s.Running() {
+		log.Infof("service %s has already exited", s.Name)
+		return nil
+	}
+
+	// The supervisor is a session leader, and the service shares its process group.
+	if err := syscall.Kill(-s.PID, syscall.SIGTERM); err != nil {
+		return fmt.Errorf("failed to stop service %s: %s", s.Name, err)
+	}
+
+	// It is killed at once if ctx is cancelled while waiting.
+	deadline := time.Now().Add(serviceStopTimeout)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		if !s.Running() {
+			log.Infof("succeeded to stop service %s", s.Name)
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := syscall.Kill(-s.PID, syscall.SIGKILL); err != nil {
+		return fmt.Errorf("failed to kill service %s: %s", s.Name, err)
+	}
+
+	log.Warnf("service %s was killed", s.Name)
+	return nil
+}
+
+// Supervise runs the command and restarts it by following the policy until it
+// receives SIGTERM or SIGINT. Outputs of the command are appended to logPath.
+func Supervise(args []string, restart config.RestartPolicy, logPath string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no command to supervise")
+	}
+
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	for {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+
+		fmt.Fprintf(logFile, "[ayame] %s start %s\n", time.Now().Format(time.RFC3339), cmd.String())
+
+		code := -1
+		if err := cmd.Start(); err != nil {
+			fmt.Fprintf(logFile, "[ayame] %s failed to start: %s\n", time.Now().Format(time.RFC3339), err)
+		} else {
+			done := make(chan error, 1)
+			go func() {
+				done <- cmd.Wait()
+			}()
+
+			select {
+			case <-sigs:
+				cmd.Process.Signal(syscall.SIGTERM)
+				<-done
+				fmt.Fprintf(logFile, "[ayame] %s stopped\n", time.Now().Format(time.RFC3339))
+				return nil
+			case <-done:
+				code = cmd.ProcessState.ExitCode()
+			}
+
+			fmt.Fprintf(logFile, "[ayame] %s exited with %d\n", time.Now().Format(time.RFC3339), code)
+		}
+
+		if restart != config.RestartAlways && (restart != config.RestartOnFailure || code == 0) {
+			return nil
+		}
+
+		select {
+		case <-sigs:
+			return nil
+		case <-time.After(restartInterval):
+		}
+	}
+}
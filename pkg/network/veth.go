@@ -15,11 +15,14 @@
 package network
 
 import (
+	"context"
 	log "github.com/sirupsen/logrus"
 )
 
 type VethConfig struct {
 	Name string `yaml:"name"`
+	// Lab prefixes the names of the veths.
+	Lab string `yaml:"lab"`
 }
 
 type Veth struct {
@@ -32,34 +35,41 @@ type VethPair struct {
 	Right Veth `json:"veth_right"`
 }
 
-func InitVethPair(config VethConfig, dryrun bool) (*VethPair, error) {
+func InitVethPair(ctx context.Context, config VethConfig) (*VethPair, error) {
+	left, right := vethNames(config.Lab, config.Name)
 	pair := &VethPair{
-		Left:  Veth{Name: config.Name + "-left", Attached: false},
-		Right: Veth{Name: config.Name + "-right", Attached: false},
+		Left:  Veth{Name: left, Attached: false},
+		Right: Veth{Name: right, Attached: false},
 	}
 
-	if err := pair.Create(dryrun); err != nil {
+	if err := pair.Create(ctx); err != nil {
 		return nil, err
 	}
 
 	return pair, nil
 }
 
-func (v *VethPair) Create(dryrun bool) error {
-	if err := RunIpLinkCreate(v.Left.Name, v.Right.Name, dryrun); err != nil {
+func (v *VethPair) Create(ctx context.Context) error {
+	if err := RunIpLinkCreate(ctx, v.Left.Name, v.Right.Name); err != nil {
 		return err
 	}
 
+	for _, name := range []string{v.Left.Name, v.Right.Name} {
+		if err := RunIpLinkSetAlias(ctx, name, ResourceTag); err != nil {
+			return err
+		}
+	}
+
 	log.Infof("succeeded to create %s@%s", v.Left.Name, v.Right.Name)
 
 	return nil
 }
 
-func (v *VethPair) Destroy(dryrun bool) error {
+func (v *VethPair) Destroy(ctx context.Context) error {
 	deleted := false
 
 	if !v.Left.Attached {
-		if err := RunIpLinkDelete(v.Left.Name, dryrun); err != nil {
+		if err := deleteHostLink(ctx, v.Left.Name); err != nil {
 			return err
 		}
 
@@ -67,7 +77,7 @@ func (v *VethPair) Destroy(dryrun bool) error {
 	}
 
 	if !deleted && !v.Right.Attached {
-		if err := RunIpLinkDelete(v.Right.Name, dryrun); err != nil {
+		if err := deleteHostLink(ctx, v.Right.Name); err != nil {
 			return err
 		}
 
@@ -83,3 +93,12 @@ func (v *VethPair) Destroy(dryrun bool) error {
 
 	return nil
 }
+
+// deleteHostLink deletes the device on the host unless it has already gone.
+func deleteHostLink(ctx context.Context, name string) error {
+	if !IsDryRun(ctx) && !linkExists(ctx, name, "") {
+		log.Infof("%s has already been deleted", name)
+		return nil
+	}
+	return RunIpLinkDelete(ctx, name)
+}
@@ -0,0 +1,185 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scenario
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
+)
+
+const (
+	reachabilityTimeout  = time.Second
+	transcriptTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// Failure is a step which failed in the run.
+type Failure struct {
+	Step        int
+	Description string
+	Reason      string
+}
+
+// Runner runs the scenario against the current lab, and writes the transcript to Out.
+type Runner struct {
+	State *state.State
+	Out   io.Writer
+}
+
+// Run runs all the steps in order. Failed assertions are recorded and the run continues,
+// but other failed steps stop the run since later steps depend on them.
+func (r *Runner) Run(ctx context.Context, sc *Scenario) []Failure {
+	var failures []Failure
+
+	r.logf("start scenario %s (%d steps)", sc.Name, len(sc.Steps))
+
+	for i, step := range sc.Steps {
+		if ctx.Err() != nil {
+			r.logf("interrupted before step %d", i+1)
+			failures = append(failures, Failure{Step: i + 1, Description: step.Description(), Reason: "interrupted"})
+			break
+		}
+
+		r.logf("step %d/%d: %s", i+1, len(sc.Steps), step.Description())
+
+		err := r.runStep(ctx, step)
+		if err == nil {
+			r.logf("step %d: ok", i+1)
+			continue
+		}
+
+		r.logf("step %d: FAILED: %s", i+1, err)
+		failures = append(failures, Failure{Step: i + 1, Description: step.Description(), Reason: err.Error()})
+
+		if step.Assert == nil {
+			r.logf("stop scenario since step %d is not an assertion", i+1)
+			break
+		}
+	}
+
+	r.logf("finish scenario %s: %d failures", sc.Name, len(failures))
+	return failures
+}
+
+func (r *Runner) logf(format string, args ...interface{}) {
+	fmt.Fprintf(r.Out, "[%s] %s\n", time.Now().Format(transcriptTimeFormat), fmt.Sprintf(format, args...))
+}
+
+func (r *Runner) namespace(name string) (*network.Namespace, error) {
+	ns := r.State.FindNamespace(name)
+	if ns == nil {
+		return nil, fmt.Errorf("namespace %s doesn't exist in the lab", name)
+	}
+	return ns, nil
+}
+
+func (r *Runner) runStep(ctx context.Context, step *Step) error {
+	switch {
+	case step.Exec != nil:
+		_, err := r.exec(ctx, step.Exec)
+		return err
+	case step.Link != nil:
+		return r.link(ctx, step.Link)
+	case step.WaitUntil != nil:
+		ns, err := r.namespace(step.WaitUntil.Namespace)
+		if err != nil {
+			return err
+		}
+		return ns.WaitReady(ctx, []config.ProbeConfig{step.WaitUntil.ProbeConfig}, r.State.Namespaces)
+	case step.Assert != nil:
+		return r.assert(ctx, step.Assert)
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(step.Sleep):
+	}
+	return nil
+}
+
+func (r *Runner) exec(ctx context.Context, e *ExecStep) (*network.CommandResult, error) {
+	ns, err := r.namespace(e.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := ns.Exec(ctx, e.commandConfig(), r.State.Namespaces)
+	if result != nil {
+		for _, line := range strings.Split(strings.TrimRight(result.Stdout, "\n"), "\n") {
+			if line != "" {
+				r.logf("  | %s", line)
+			}
+		}
+	}
+
+	return result, err
+}
+
+func (r *Runner) link(ctx context.Context, l *LinkStep) error {
+	ns, err := r.namespace(l.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ifname, err := ns.DeviceIfname(l.Device)
+	if err != nil {
+		return err
+	}
+
+	if l.State != "" {
+		return network.RunIpLinkSetState(ctx, ifname, ns.NetnsName(), l.State == LinkUp)
+	}
+
+	return network.RunTcNetem(ctx, ifname, ns.NetnsName(), l.Impairment.netemArgs())
+}
+
+func (r *Runner) assert(ctx context.Context, a *AssertStep) error {
+	if a.Reachable != nil {
+		res := r.State.EvaluateExpectations([]config.ExpectConfig{*a.Reachable}, reachabilityTimeout)[0]
+		r.logf("  %s", res.Detail)
+		if !res.Passed {
+			return fmt.Errorf("%s: %s", res.Expect.String(), res.Detail)
+		}
+		return nil
+	}
+
+	result, err := r.exec(ctx, a.Exec)
+	if err != nil {
+		return err
+	}
+
+	if a.Output == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(a.Output)
+	if err != nil {
+		return fmt.Errorf("invalid output pattern %q: %s", a.Output, err)
+	}
+
+	if !re.MatchString(result.Stdout) {
+		return fmt.Errorf("output of %q doesn't match %q", a.Exec.Command, a.Output)
+	}
+
+	return nil
+}
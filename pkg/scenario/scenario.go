@@ -0,0 +1,227 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scenario
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"gopkg.in/yaml.v2"
+)
+
+// ExecStep runs a command inside the namespace.
+type ExecStep struct {
+	Namespace  string        `yaml:"namespace"`
+	Command    string        `yaml:"command"`
+	Shell      bool          `yaml:"shell"`
+	Timeout    time.Duration `yaml:"timeout"`
+	ExpectExit int           `yaml:"expect_exit"`
+}
+
+func (e *ExecStep) commandConfig() config.CommandConfig {
+	return config.CommandConfig{
+		Command:    e.Command,
+		Shell:      e.Shell,
+		Timeout:    e.Timeout,
+		ExpectExit: e.ExpectExit,
+	}
+}
+
+const (
+	LinkUp   = "up"
+	LinkDown = "down"
+)
+
+// ImpairmentConfig is applied with netem. Values are passed to tc as they are,
+// e.g. delay: 100ms, loss: 10%, rate: 1mbit. Clear removes the impairment.
+type ImpairmentConfig struct {
+	Delay  string `yaml:"delay"`
+	Jitter string `yaml:"jitter"`
+	Loss   string `yaml:"loss"`
+	Rate   string `yaml:"rate"`
+	Clear  bool   `yaml:"clear"`
+}
+
+// LinkStep changes the state or the impairment of the device in the namespace.
+type LinkStep struct {
+	Namespace  string            `yaml:"namespace"`
+	Device     string            `yaml:"device"`
+	State      string            `yaml:"state"`
+	Impairment *ImpairmentConfig `yaml:"impairment"`
+}
+
+// WaitStep blocks until the probe succeeds inside the namespace.
+type WaitStep struct {
+	Namespace          string `yaml:"namespace"`
+	config.ProbeConfig `yaml:",inline"`
+}
+
+// AssertStep checks the reachability, or the output of the command.
+type AssertStep struct {
+	Reachable *config.ExpectConfig `yaml:"reachable"`
+	Exec      *ExecStep            `yaml:"exec"`
+	// Output is a regular expression matched with stdout of Exec.
+	Output string `yaml:"output"`
+}
+
+// Step must have only one action.
+type Step struct {
+	Name      string        `yaml:"name"`
+	Exec      *ExecStep     `yaml:"exec"`
+	Link      *LinkStep     `yaml:"link"`
+	Sleep     time.Duration `yaml:"sleep"`
+	WaitUntil *WaitStep     `yaml:"wait_until"`
+	Assert    *AssertStep   `yaml:"assert"`
+}
+
+type Scenario struct {
+	Name  string  `yaml:"name"`
+	Steps []*Step `yaml:"steps"`
+}
+
+func ParseScenario(bytes []byte) (*Scenario, error) {
+	sc := Scenario{}
+	if err := yaml.UnmarshalStrict(bytes, &sc); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario: %s", err)
+	}
+
+	for i, step := range sc.Steps {
+		if err := validateStep(step); err != nil {
+			return nil, fmt.Errorf("step %d: %s", i+1, err)
+		}
+	}
+
+	return &sc, nil
+}
+
+func validateStep(step *Step) error {
+	actions := 0
+	if step.Exec != nil {
+		actions++
+	}
+	if step.Link != nil {
+		actions++
+	}
+	if step.Sleep != 0 {
+		actions++
+	}
+	if step.WaitUntil != nil {
+		actions++
+	}
+	if step.Assert != nil {
+		actions++
+	}
+	if actions != 1 {
+		return fmt.Errorf("must have only one of exec, link, sleep, wait_until and assert")
+	}
+
+	switch {
+	case step.Exec != nil:
+		return validateExec(step.Exec)
+	case step.Link != nil:
+		if step.Link.Namespace == "" || step.Link.Device == "" {
+			return fmt.Errorf("link must have namespace and device")
+		}
+		if (step.Link.State == "") == (step.Link.Impairment == nil) {
+			return fmt.Errorf("link must have only one of state and impairment")
+		}
+		if step.Link.State != "" && step.Link.State != LinkUp && step.Link.State != LinkDown {
+			return fmt.Errorf("unknown link state %s", step.Link.State)
+		}
+		if i := step.Link.Impairment; i != nil && !i.Clear && len(i.netemArgs()) == 0 {
+			return fmt.Errorf("impairment must have any of delay, loss and rate, or clear")
+		}
+	case step.Sleep < 0:
+		return fmt.Errorf("sleep must not be negative")
+	case step.WaitUntil != nil:
+		if step.WaitUntil.Namespace == "" {
+			return fmt.Errorf("wait_until must have namespace")
+		}
+		return config.ValidateProbe(&step.WaitUntil.ProbeConfig)
+	case step.Assert != nil:
+		a := step.Assert
+		if (a.Reachable == nil) == (a.Exec == nil) {
+			return fmt.Errorf("assert must have only one of reachable and exec")
+		}
+		if a.Reachable != nil {
+			a.Reachable.ApplyDefaults()
+			return config.ValidateExpectation(a.Reachable)
+		}
+		if _, err := regexp.Compile(a.Output); err != nil {
+			return fmt.Errorf("invalid output pattern %q: %s", a.Output, err)
+		}
+		return validateExec(a.Exec)
+	}
+
+	return nil
+}
+
+func validateExec(e *ExecStep) error {
+	if e.Namespace == "" {
+		return fmt.Errorf("exec must have namespace")
+	}
+	if e.Command == "" {
+		return fmt.Errorf("exec must have command")
+	}
+	return nil
+}
+
+// Description is a short summary of the step for the transcript.
+func (s *Step) Description() string {
+	if s.Name != "" {
+		return s.Name
+	}
+
+	switch {
+	case s.Exec != nil:
+		return fmt.Sprintf("exec %q in %s", s.Exec.Command, s.Exec.Namespace)
+	case s.Link != nil && s.Link.State != "":
+		return fmt.Sprintf("set %s in %s %s", s.Link.Device, s.Link.Namespace, s.Link.State)
+	case s.Link != nil:
+		return fmt.Sprintf("impair %s in %s", s.Link.Device, s.Link.Namespace)
+	case s.WaitUntil != nil:
+		return fmt.Sprintf("wait until probe succeeds in %s", s.WaitUntil.Namespace)
+	case s.Assert != nil && s.Assert.Reachable != nil:
+		return fmt.Sprintf("assert %s", s.Assert.Reachable.String())
+	case s.Assert != nil:
+		return fmt.Sprintf("assert output of %q in %s", s.Assert.Exec.Command, s.Assert.Exec.Namespace)
+	}
+
+	return fmt.Sprintf("sleep %s", s.Sleep)
+}
+
+// netemArgs converts the impairment into arguments of `tc qdisc ... netem`.
+func (i *ImpairmentConfig) netemArgs() []string {
+	if i.Clear {
+		return nil
+	}
+
+	var args []string
+	if i.Delay != "" {
+		args = append(args, "delay", i.Delay)
+		if i.Jitter != "" {
+			args = append(args, i.Jitter)
+		}
+	}
+	if i.Loss != "" {
+		args = append(args, "loss", i.Loss)
+	}
+	if i.Rate != "" {
+		args = append(args, "rate", i.Rate)
+	}
+	return args
+}
@@ -0,0 +1,252 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+// build creates the resources of the config with the operations in a dependency graph.
+// Operations independent of each other run concurrently.
+type build struct {
+	graph *network.Graph
+
+	// Resources are stored by the index in the config, so that the operations don't
+	// share maps and the state doesn't depend on the order they finish.
+	dlinks     []*network.DirectLink
+	bridges    []*network.Bridge
+	namespaces []*network.Namespace
+}
+
+const wiredOp = "wired"
+
+func netnsOp(name string) string  { return "netns/" + name }
+func linkOp(name string) string   { return "link/" + name }
+func bridgeOp(name string) string { return "bridge/" + name }
+func startOp(name string) string  { return "start/" + name }
+
+// newBuild plans the operations. Namespaces are created along with links and bridges,
+// then attached to them, and started in the order of their dependencies after all of
+// them are wired.
+func newBuild(cfg *config.Config, lab string, logDir string) (*build, error) {
+	b := &build{
+		graph:      network.NewGraph(),
+		namespaces: make([]*network.Namespace, len(cfg.Namespaces)),
+	}
+
+	linkIdx := make(map[string]int)
+	bridgeIdx := make(map[string]int)
+	for _, link := range cfg.Links {
+		link := link
+		switch link.LinkMode {
+		case config.ModeDirectLink:
+			idx := len(b.dlinks)
+			linkIdx[link.Name] = idx
+			b.dlinks = append(b.dlinks, nil)
+			if err := b.graph.Add(linkOp(link.Name), nil, func(ctx context.Context) error {
+				dlink, err := network.InitDirectLink(ctx, link, lab)
+				if err != nil {
+					return fmt.Errorf("failed to init direct link: %s: %s", link.Name, err)
+				}
+				b.dlinks[idx] = dlink
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+		case config.ModeBridge:
+			idx := len(b.bridges)
+			bridgeIdx[link.Name] = idx
+			b.bridges = append(b.bridges, nil)
+			if err := b.graph.Add(bridgeOp(link.Name), nil, func(ctx context.Context) error {
+				br, err := network.InitBridge(ctx, link, lab)
+				if err != nil {
+					return fmt.Errorf("failed to init bridge: %s: %s", link.Name, err)
+				}
+				b.bridges[idx] = br
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	nsIdx := make(map[string]int)
+	for i, nscfg := range cfg.Namespaces {
+		i, nscfg := i, nscfg
+		nsIdx[nscfg.Name] = i
+		if err := b.graph.Add(netnsOp(nscfg.Name), nil, func(ctx context.Context) error {
+			ns, err := network.InitNamespace(ctx, nscfg, lab)
+			if err != nil {
+				return err
+			}
+			b.namespaces[i] = ns
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	var wired []string
+
+	// Each direct link connects exactly two namespaces.
+	linkEnds := make(map[string][]int)
+	for i, nscfg := range cfg.Namespaces {
+		for _, dev := range nscfg.Devices {
+			if _, ok := linkIdx[dev.Name]; ok {
+				linkEnds[dev.Name] = append(linkEnds[dev.Name], i)
+			}
+		}
+	}
+
+	// Links are attached in the order of names, so that the commands are deterministic.
+	var names []string
+	for name := range linkEnds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Attaching changes the devices of the namespace, so attaches to the same namespace
+	// run one by one.
+	lastNsAttach := make(map[string]string)
+	chain := func(deps []string, ns string) []string {
+		if prev, ok := lastNsAttach[ns]; ok {
+			deps = append(deps, prev)
+		}
+		return deps
+	}
+
+	for _, name := range names {
+		ends := linkEnds[name]
+		if len(ends) != 2 {
+			return nil, fmt.Errorf("%s should have only 2 link in %s\n", name, cfg.Namespaces[ends[0]].Name)
+		}
+
+		name, idx, left, right := name, linkIdx[name], ends[0], ends[1]
+		op := "attach/" + name
+		leftName, rightName := cfg.Namespaces[left].Name, cfg.Namespaces[right].Name
+		deps := []string{linkOp(name), netnsOp(leftName), netnsOp(rightName)}
+		deps = chain(chain(deps, leftName), rightName)
+		if err := b.graph.Add(op, deps, func(ctx context.Context) error {
+			if err := b.dlinks[idx].CreateLink(ctx, b.namespaces[left], b.namespaces[right]); err != nil {
+				return fmt.Errorf("failed to create links %s: %s", name, err.Error())
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		lastNsAttach[leftName], lastNsAttach[rightName] = op, op
+		wired = append(wired, op)
+	}
+
+	// Pairs of a bridge are numbered in the order of namespaces, so they are attached one by one.
+	lastAttach := make(map[string]string)
+	for i, nscfg := range cfg.Namespaces {
+		for _, dev := range nscfg.Devices {
+			idx, ok := bridgeIdx[dev.Name]
+			if !ok {
+				continue
+			}
+
+			i, brName := i, dev.Name
+			op := "attach/" + brName + "/" + nscfg.Name
+			deps := []string{bridgeOp(brName), netnsOp(nscfg.Name)}
+			if prev, ok := lastAttach[brName]; ok {
+				deps = append(deps, prev)
+			}
+			deps = chain(deps, nscfg.Name)
+			if err := b.graph.Add(op, deps, func(ctx context.Context) error {
+				ns := b.namespaces[i]
+				if err := b.bridges[idx].CreateLink(ctx, ns); err != nil {
+					return fmt.Errorf("failed to link %s to bridge %s: %s", ns.Name, brName, err)
+				}
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+			lastAttach[brName] = op
+			lastNsAttach[nscfg.Name] = op
+			wired = append(wired, op)
+		}
+	}
+
+	if err := b.graph.Add(wiredOp, wired, func(ctx context.Context) error { return nil }); err != nil {
+		return nil, err
+	}
+
+	order, err := config.StartupOrder(cfg.Namespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, nscfg := range order {
+		nscfg, i := nscfg, nsIdx[nscfg.Name]
+		deps := []string{wiredOp}
+		for _, dep := range nscfg.DependsOn {
+			deps = append(deps, startOp(dep))
+		}
+		if err := b.graph.Add(startOp(nscfg.Name), deps, func(ctx context.Context) error {
+			return startNamespace(ctx, b.namespaces[i], nscfg, b.namespaces, cfg.CommandFailurePolicy, logDir)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// run runs the operations with the workers.
+func (b *build) run(ctx context.Context, workers int) error {
+	return b.graph.Run(ctx, workers)
+}
+
+// started reports whether any namespace has started to run its commands.
+func (b *build) started() bool {
+	for _, ns := range b.namespaces {
+		if ns != nil && b.graph.Started(startOp(ns.Name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// created returns the resources created by the operations done.
+func (b *build) created() (map[string]*network.DirectLink, map[string]*network.Bridge, []*network.Namespace) {
+	dlinks := make(map[string]*network.DirectLink)
+	for _, d := range b.dlinks {
+		if d != nil {
+			dlinks[d.Name] = d
+		}
+	}
+
+	brs := make(map[string]*network.Bridge)
+	for _, br := range b.bridges {
+		if br != nil {
+			brs[br.Name] = br
+		}
+	}
+
+	var nss []*network.Namespace
+	for _, ns := range b.namespaces {
+		if ns != nil {
+			nss = append(nss, ns)
+		}
+	}
+
+	return dlinks, brs, nss
+}
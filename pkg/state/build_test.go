@@ -0,0 +1,99 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+// ns1 is attached to two direct links and a bridge, so that its attaches would race
+// if they weren't chained.
+const multiLinkConfig = `
+links:
+  - name: veth1
+    mode: direct_link
+  - name: veth2
+    mode: direct_link
+  - name: veth3
+    mode: direct_link
+  - name: br1
+    mode: bridge
+namespaces:
+  - name: ns1
+    devices:
+      - name: veth1
+        cidr: 10.0.1.1/24
+      - name: veth2
+        cidr: 10.0.2.1/24
+      - name: veth3
+        cidr: 10.0.3.1/24
+      - name: br1
+        cidr: 10.0.4.1/24
+  - name: ns2
+    devices:
+      - name: veth1
+        cidr: 10.0.1.2/24
+      - name: veth2
+        cidr: 10.0.2.2/24
+      - name: br1
+        cidr: 10.0.4.2/24
+  - name: ns3
+    devices:
+      - name: veth3
+        cidr: 10.0.3.2/24
+      - name: br1
+        cidr: 10.0.4.3/24
+`
+
+func TestBuildAttachesInParallel(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(multiLinkConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The steps are recorded by the parallel operations, as create does.
+	journal := newMemoryJournal()
+
+	for i := 0; i < 20; i++ {
+		ctx := network.WithRecorder(network.WithExecutor(context.Background(), &network.FakeExecutor{}), journal)
+
+		b, err := newBuild(cfg, "test", t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.run(ctx, 8); err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, nss := b.created()
+		if len(nss) != len(cfg.Namespaces) {
+			t.Fatalf("got %d namespaces, want %d", len(nss), len(cfg.Namespaces))
+		}
+		for _, ns := range nss {
+			for _, dev := range ns.RegisteredDeviceConfig {
+				if dev.AttachedVeth == "" {
+					t.Errorf("device %s of %s is not attached", dev.Name, ns.Name)
+				}
+			}
+		}
+	}
+
+	if journal.Pending() == 0 {
+		t.Error("no steps are recorded")
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+type ExpectResult struct {
+	Expect config.ExpectConfig
+	Passed bool
+	// Indeterminate is set if the reachability couldn't be told, and then Passed is false.
+	Indeterminate bool
+	Detail        string
+}
+
+// Status returns PASS, FAIL or UNKNOWN for indeterminate results.
+func (r ExpectResult) Status() string {
+	switch {
+	case r.Passed:
+		return "PASS"
+	case r.Indeterminate:
+		return "UNKNOWN"
+	}
+	return "FAIL"
+}
+
+// EvaluateExpectations checks the reachability declared in the expectations.
+func (s *State) EvaluateExpectations(expects []config.ExpectConfig, timeout time.Duration) []ExpectResult {
+	var results []ExpectResult
+	for _, e := range expects {
+		results = append(results, s.evaluate(e, timeout))
+	}
+	return results
+}
+
+func (s *State) evaluate(e config.ExpectConfig, timeout time.Duration) ExpectResult {
+	result := ExpectResult{Expect: e}
+
+	from := s.FindNamespace(e.From)
+	if from == nil {
+		result.Detail = fmt.Sprintf("namespace %s doesn't exist", e.From)
+		return result
+	}
+
+	var targets []net.IP
+	if e.To != "" {
+		to := s.FindNamespace(e.To)
+		if to == nil {
+			result.Detail = fmt.Sprintf("namespace %s doesn't exist", e.To)
+			return result
+		}
+		targets = to.Addresses()
+	} else {
+		targets = append(targets, net.ParseIP(e.Address))
+	}
+
+	reached := false
+	var lastErr, indeterminate error
+	for _, ip := range targets {
+		if err := network.CheckReachable(from.NetnsName(), ip, e.Protocol, e.Port, timeout); err != nil {
+			if errors.Is(err, network.ErrIndeterminate) {
+				indeterminate = err
+			}
+			lastErr = err
+			continue
+		}
+
+		reached = true
+		result.Detail = fmt.Sprintf("reached %s", ip)
+		break
+	}
+
+	if !reached && indeterminate != nil {
+		// Neither the expectation nor its opposite is confirmed.
+		result.Indeterminate = true
+		result.Detail = indeterminate.Error()
+		return result
+	}
+
+	if !reached {
+		if lastErr != nil {
+			result.Detail = lastErr.Error()
+		} else {
+			result.Detail = "no address to probe"
+		}
+	}
+
+	result.Passed = reached == e.ShouldReach()
+	return result
+}
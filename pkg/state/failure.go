@@ -0,0 +1,75 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+const failedRunFileName = "failed-run.json"
+
+// FailedRun is the record of the creation rolled back on failure. The namespaces are gone
+// after the rollback, so the outputs of their commands are kept only in this record.
+type FailedRun struct {
+	Lab   string    `json:"lab"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+	// Hooks are the results of pre_create and post_create hooks run so far.
+	Hooks []network.CommandResult `json:"hooks,omitempty"`
+	// Commands are the results of the commands run so far in each namespace.
+	Commands map[string][]network.CommandResult `json:"commands,omitempty"`
+}
+
+func failedRunFile(lab string) string {
+	return filepath.Join(labDir(lab), failedRunFileName)
+}
+
+// saveFailedRun writes the record of the failed creation before it is rolled back,
+// and returns its path. It is removed when the lab is created successfully.
+func saveFailedRun(lab string, err error, hooks []network.CommandResult, nss []*network.Namespace) (string, error) {
+	run := &FailedRun{Lab: lab, Time: time.Now(), Error: err.Error(), Hooks: hooks, Commands: make(map[string][]network.CommandResult)}
+	for _, ns := range nss {
+		if len(ns.CommandResults) != 0 {
+			run.Commands[ns.Name] = ns.CommandResults
+		}
+	}
+
+	// Commands are more readable without escaping shell operators like >&.
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(run); err != nil {
+		return "", err
+	}
+
+	dir := labDir(lab)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %s", dir, err)
+	}
+
+	path := failedRunFile(lab)
+	if err := writeFileAtomic(path, b.Bytes()); err != nil {
+		return "", fmt.Errorf("failed to save %s: %s", path, err)
+	}
+	fixOwnership(dir)
+	return path, nil
+}
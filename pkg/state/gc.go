@@ -0,0 +1,166 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+// Orphan is a resource tagged by ayame but not referenced by any state.
+type Orphan struct {
+	Kind string
+	Name string
+	// Netns is the namespace of the veth, or empty on the host.
+	Netns string
+}
+
+func (o Orphan) String() string {
+	if o.Netns != "" {
+		return fmt.Sprintf("%s %s in %s", o.Kind, o.Name, o.Netns)
+	}
+	return fmt.Sprintf("%s %s", o.Kind, o.Name)
+}
+
+// FindOrphans lists the tagged namespaces, veths and bridges which aren't in any saved state.
+// Bridges are skipped if OpenvSwitch isn't installed.
+func FindOrphans(ctx context.Context) ([]Orphan, error) {
+	netns := make(map[string]bool)
+	veths := make(map[string]bool)
+	bridges := make(map[string]bool)
+
+	states, err := LoadAllResources()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range states {
+		for _, n := range s.Namespaces {
+			netns[n.NetnsName()] = true
+		}
+		for _, d := range s.DirectLinks {
+			veths[d.VethPair.Left.Name] = true
+			veths[d.VethPair.Right.Name] = true
+		}
+		for _, br := range s.Bridges {
+			bridges[br.OvsName()] = true
+			for _, p := range br.VethPairs {
+				veths[p.Left.Name] = true
+				veths[p.Right.Name] = true
+			}
+		}
+	}
+
+	var orphans []Orphan
+	all := network.ListNetns(ctx)
+
+	// Veths go first, since deleting namespaces also deletes the veths inside them.
+	for _, ns := range append([]string{""}, sortedKeys(netns)...) {
+		if ns != "" && !all[ns] {
+			continue
+		}
+
+		links, err := network.ListLinks(ctx, ns)
+		if err != nil {
+			return nil, err
+		}
+
+		found := make(map[string]bool)
+		for _, name := range sortedLinks(links) {
+			link := links[name]
+			if link.Alias != network.ResourceTag || veths[name] {
+				continue
+			}
+			// Deleting one end of the pair deletes the other.
+			if found[link.Peer] {
+				continue
+			}
+
+			found[name] = true
+			orphans = append(orphans, Orphan{Kind: "veth", Name: name, Netns: ns})
+		}
+	}
+
+	for _, ns := range sortedKeys(all) {
+		if strings.HasPrefix(ns, network.NetnsPrefix) && !netns[ns] {
+			orphans = append(orphans, Orphan{Kind: "namespace", Name: ns})
+		}
+	}
+
+	var tagged []string
+	if network.OvsAvailable(ctx) {
+		var err error
+		if tagged, err = network.ListTaggedBridges(ctx); err != nil {
+			log.Warnf("skip bridges: %s", err)
+		}
+	}
+	for _, br := range tagged {
+		if !bridges[br] {
+			orphans = append(orphans, Orphan{Kind: "bridge", Name: br})
+		}
+	}
+
+	return orphans, nil
+}
+
+// DeleteOrphans deletes the resources found by FindOrphans.
+func DeleteOrphans(ctx context.Context, orphans []Orphan) error {
+	var allerr error
+	for _, o := range orphans {
+		if ctx.Err() != nil {
+			return multierr.Append(allerr, ctx.Err())
+		}
+
+		var err error
+		switch {
+		case o.Kind == "veth" && o.Netns == "":
+			err = network.RunIpLinkDelete(ctx, o.Name)
+		case o.Kind == "veth":
+			err = network.RunIpLinkDeleteInNamespace(ctx, o.Name, o.Netns)
+		case o.Kind == "namespace":
+			err = network.RunIpNetnsDelete(ctx, o.Name)
+		case o.Kind == "bridge":
+			err = network.DeleteBridge(ctx, o.Name)
+		}
+
+		if err != nil {
+			allerr = multierr.Append(allerr, err)
+		}
+	}
+	return allerr
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedLinks(m map[string]network.LinkInfo) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
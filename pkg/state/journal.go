@@ -0,0 +1,262 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+const journalFileName = "journal.jsonl"
+
+// Phases of the teardown recorded in the journal, so that an interrupted delete resumes after them.
+const (
+	phasePreDelete  = "pre_delete"
+	phaseOnDelete   = "on_delete"
+	phaseLinks      = "links"
+	phaseBridges    = "bridges"
+	phaseNamespaces = "namespaces"
+)
+
+// journalEntry is a line of the journal. Exactly one of the fields is set.
+type journalEntry struct {
+	Step *network.Step `json:"step,omitempty"`
+	// Undone is the 1-origin index of the step which has been reverted.
+	Undone int    `json:"undone,omitempty"`
+	Phase  string `json:"phase,omitempty"`
+}
+
+// Journal records the changes to the kernel made while a lab is created or deleted.
+// Every entry is written to the disk before the next change, so that a crashed
+// ayame can be rolled back exactly. Steps are recorded by the operations running in
+// parallel, so the entries are guarded by mu.
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	// file is nil if the journal is kept only in memory.
+	file   *os.File
+	steps  []network.Step
+	undone map[int]bool
+	phases map[string]bool
+}
+
+func journalFile(lab string) string {
+	return filepath.Join(labDir(lab), journalFileName)
+}
+
+func journalExists(lab string) bool {
+	_, err := os.Stat(journalFile(lab))
+	return err == nil
+}
+
+// OpenJournal reads the journal of the lab, and opens it to append entries.
+func OpenJournal(lab string) (*Journal, error) {
+	dir := labDir(lab)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %s", dir, err)
+	}
+
+	j := &Journal{
+		path:   journalFile(lab),
+		undone: make(map[int]bool),
+		phases: make(map[string]bool),
+	}
+
+	f, err := os.OpenFile(j.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %s", j.path, err)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// The last line can be half-written by a crash.
+			log.Warnf("ignore broken entry of %s: %s", j.path, err)
+			continue
+		}
+		j.apply(e)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read %s: %s", j.path, err)
+	}
+
+	j.file = f
+	fixOwnership(dir)
+	return j, nil
+}
+
+// newMemoryJournal returns the journal which isn't written to the disk. It is used
+// by flows which don't touch the host.
+func newMemoryJournal() *Journal {
+	return &Journal{
+		undone: make(map[int]bool),
+		phases: make(map[string]bool),
+	}
+}
+
+func (j *Journal) apply(e journalEntry) {
+	switch {
+	case e.Step != nil:
+		j.steps = append(j.steps, *e.Step)
+	case e.Undone != 0:
+		j.undone[e.Undone] = true
+	case e.Phase != "":
+		j.phases[e.Phase] = true
+	}
+}
+
+func (j *Journal) append(e journalEntry) error {
+	if j.file == nil {
+		j.apply(e)
+		return nil
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write %s: %s", j.path, err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %s", j.path, err)
+	}
+
+	j.apply(e)
+	return nil
+}
+
+// Record implements network.Recorder.
+func (j *Journal) Record(step network.Step) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.append(journalEntry{Step: &step})
+}
+
+// Discard implements network.Recorder. The step is marked as reverted, since the change
+// hasn't been made.
+func (j *Journal) Discard(step network.Step) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for i := len(j.steps); i > 0; i-- {
+		if !j.undone[i] && j.steps[i-1].String() == step.String() {
+			return j.append(journalEntry{Undone: i})
+		}
+	}
+	return nil
+}
+
+// Pending returns the number of the steps which haven't been reverted.
+func (j *Journal) Pending() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return len(j.steps) - len(j.undone)
+}
+
+// mark returns the position of the next step, so that the steps recorded after it
+// can be rolled back by rollbackSince.
+func (j *Journal) mark() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return len(j.steps)
+}
+
+// Rollback reverts the steps in the reverse order. It continues on errors so that
+// as many resources as possible are removed, and the failed steps are left to retry.
+func (j *Journal) Rollback(ctx context.Context) error {
+	return j.rollbackSince(ctx, 0)
+}
+
+// rollbackSince reverts the steps recorded after the mark.
+func (j *Journal) rollbackSince(ctx context.Context, mark int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// Undoing isn't recorded, so the lock is held while the steps are reverted.
+	ctx = network.WithRecorder(ctx, nil)
+
+	var allerr error
+	for i := len(j.steps); i > mark; i-- {
+		if j.undone[i] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return multierr.Append(allerr, err)
+		}
+
+		step := j.steps[i-1]
+		log.Infof("rollback %s", step.String())
+		if err := network.UndoStep(ctx, step); err != nil {
+			allerr = multierr.Append(allerr, fmt.Errorf("failed to rollback %s: %s", step.String(), err))
+			continue
+		}
+
+		if err := j.append(journalEntry{Undone: i}); err != nil {
+			return multierr.Append(allerr, err)
+		}
+	}
+	return allerr
+}
+
+func (j *Journal) done(phase string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.phases[phase]
+}
+
+func (j *Journal) markDone(phase string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.append(journalEntry{Phase: phase})
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+// Remove closes the journal and deletes it, since the changes are committed to the state.
+func (j *Journal) Remove() error {
+	j.Close()
+	if j.file == nil {
+		return nil
+	}
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
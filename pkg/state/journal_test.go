@@ -0,0 +1,70 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+func TestJournalWriteAhead(t *testing.T) {
+	useStateDir(t)
+
+	journal, err := OpenJournal("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	e := &network.FakeExecutor{Respond: func(cmd *network.Command) (string, error) {
+		// The step must be on the disk before the change is made.
+		b, err := ioutil.ReadFile(journalFile("test"))
+		if err != nil || !strings.Contains(string(b), network.StepNetnsAdd) {
+			t.Errorf("%s is executed before it is journaled", cmd.String())
+		}
+
+		if cmd.Args[len(cmd.Args)-1] == "exists" {
+			return "", &network.ExitError{Code: 1, Stderr: "File exists"}
+		}
+		return "", nil
+	}}
+	ctx := network.WithRecorder(network.WithExecutor(context.Background(), e), journal)
+
+	if err := network.RunIpNetnsAdd(ctx, "created"); err != nil {
+		t.Fatal(err)
+	}
+	if journal.Pending() != 1 {
+		t.Errorf("expected 1 pending step, got %d", journal.Pending())
+	}
+
+	// The namespace which existed before isn't deleted by the rollback.
+	if err := network.RunIpNetnsAdd(ctx, "exists"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if journal.Pending() != 1 {
+		t.Errorf("expected the failed step to be discarded, got %d pending steps", journal.Pending())
+	}
+
+	// Steps are kept when they are interrupted, since the change may have been made.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	network.RunIpNetnsAdd(cancelled, "interrupted")
+	if journal.Pending() != 2 {
+		t.Errorf("expected the interrupted step to be kept, got %d pending steps", journal.Pending())
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+// DefaultLab is the name given to the state saved before labs were introduced.
+const DefaultLab = "default"
+
+// LabSummary is a lab shown by `ayame list`.
+type LabSummary struct {
+	Name        string
+	Namespaces  int
+	DirectLinks int
+	Bridges     int
+	CreatedAt   *time.Time
+}
+
+// ListLabs returns the names of the saved labs.
+func ListLabs() ([]string, error) {
+	migrateLegacyStates()
+
+	files, err := ioutil.ReadDir(filepath.Join(statePath, labsDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var labs []string
+	for _, f := range files {
+		// Labs whose creation was interrupted are listed to be deleted.
+		if f.IsDir() && (ResourcesSaved(f.Name()) || journalExists(f.Name())) {
+			labs = append(labs, f.Name())
+		}
+	}
+	sort.Strings(labs)
+	return labs, nil
+}
+
+// CheckLabPrefix fails if the interface names of the new lab can collide with the ones of
+// an existing lab, since they share the prefix made from the hash of the lab name.
+func CheckLabPrefix(lab string) error {
+	labs, err := ListLabs()
+	if err != nil {
+		return err
+	}
+
+	prefix := network.LabPrefix(lab)
+	for _, other := range labs {
+		if other != lab && network.LabPrefix(other) == prefix {
+			return fmt.Errorf("interfaces of lab %s would collide with lab %s since both are prefixed with %s, use another name with --lab",
+				lab, other, prefix)
+		}
+	}
+	return nil
+}
+
+// Interrupted reports whether the creation of the lab was interrupted before its state was saved.
+func Interrupted(lab string) bool {
+	return !ResourcesSaved(lab) && journalExists(lab)
+}
+
+// LoadAllResources returns the states of all the saved labs. It fails if any of them is corrupt.
+func LoadAllResources() ([]*State, error) {
+	labs, err := ListLabs()
+	if err != nil {
+		return nil, err
+	}
+
+	var states []*State
+	for _, lab := range labs {
+		s, err := LoadResources(lab)
+		if err == ErrNoResources {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, s)
+	}
+	return states, nil
+}
+
+func (s *State) createdAt() *time.Time {
+	if s.Metadata == nil {
+		return nil
+	}
+	return s.Metadata.CreatedAt
+}
+
+func (s *State) Summary() LabSummary {
+	return LabSummary{
+		Name:        s.Lab,
+		Namespaces:  len(s.Namespaces),
+		DirectLinks: len(s.DirectLinks),
+		Bridges:     len(s.Bridges),
+		CreatedAt:   s.createdAt(),
+	}
+}
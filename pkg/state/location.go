@@ -0,0 +1,199 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// StateDirEnv overrides the default directory of the state.
+	StateDirEnv = "AYAME_STATE_DIR"
+	// DefaultStateDir keeps the state across reboots, so that labs can be deleted or restored.
+	DefaultStateDir = "/var/lib/ayame"
+
+	legacyStateDirName = ".ayame"
+)
+
+var statePath = resolveStateDir("")
+
+// SetStateDir changes the directory of the state. AYAME_STATE_DIR or the default is used if dir is empty.
+func SetStateDir(dir string) {
+	statePath = resolveStateDir(dir)
+}
+
+// StateDir returns the directory of the state.
+func StateDir() string {
+	return statePath
+}
+
+func resolveStateDir(dir string) string {
+	if dir == "" {
+		dir = os.Getenv(StateDirEnv)
+	}
+	if dir == "" {
+		dir = DefaultStateDir
+	}
+
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+	return dir
+}
+
+// invoker is the user who ran ayame with sudo.
+type invoker struct {
+	uid  int
+	gid  int
+	home string
+}
+
+func sudoInvoker() *invoker {
+	uid, err := strconv.Atoi(os.Getenv("SUDO_UID"))
+	if err != nil {
+		return nil
+	}
+	gid, err := strconv.Atoi(os.Getenv("SUDO_GID"))
+	if err != nil {
+		return nil
+	}
+
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return nil
+	}
+	return &invoker{uid: uid, gid: gid, home: u.HomeDir}
+}
+
+// fixOwnership gives the files under the home of the user who ran sudo back to them.
+// Other locations are left to root.
+func fixOwnership(path string) {
+	inv := sudoInvoker()
+	if inv == nil || inv.home == "" || !strings.HasPrefix(path, inv.home+string(filepath.Separator)) {
+		return
+	}
+
+	// Directories between the home and the state are created by ayame too.
+	for dir := filepath.Dir(path); strings.HasPrefix(dir, inv.home+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if err := os.Lchown(dir, inv.uid, inv.gid); err != nil {
+			log.Warnf("failed to change owner of %s: %s", dir, err)
+			return
+		}
+	}
+
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if err := os.Lchown(p, inv.uid, inv.gid); err != nil {
+			log.Warnf("failed to change owner of %s: %s", p, err)
+		}
+		return nil
+	})
+}
+
+// legacyStateDirs returns $HOME/.ayame of the user who ran sudo and the current user.
+func legacyStateDirs() []string {
+	var homes []string
+	if inv := sudoInvoker(); inv != nil {
+		homes = append(homes, inv.home)
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		homes = append(homes, home)
+	}
+
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, home := range homes {
+		dir := filepath.Join(home, legacyStateDirName)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// migrateLegacyStates moves the states saved by older versions into the state directory.
+// Logs of services are left where they are, since their paths are in the states.
+func migrateLegacyStates() {
+	for _, dir := range legacyStateDirs() {
+		// state.json saved before labs were introduced.
+		migrateLegacyState(filepath.Join(dir, stateFileName), DefaultLab)
+
+		if dir == statePath {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(dir, labsDirName))
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			migrateLegacyState(filepath.Join(dir, labsDirName, f.Name(), stateFileName), f.Name())
+		}
+	}
+}
+
+func migrateLegacyState(path string, lab string) {
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+
+	if err := Lock(); err != nil {
+		log.Warnf("failed to migrate %s: %s", path, err)
+		return
+	}
+	defer Unlock()
+
+	// Another process may have migrated it while waiting for the lock.
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	if ResourcesSaved(lab) {
+		log.Warnf("%s is left, since lab %s already exists in %s", path, lab, statePath)
+		return
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Warnf("failed to read %s: %s", path, err)
+		return
+	}
+
+	s, err := LoadStateFromBytes(b)
+	if err != nil {
+		log.Warnf("failed to parse %s: %s", path, err)
+		return
+	}
+
+	s.Lab = lab
+	if err := s.SaveState(); err != nil {
+		log.Warnf("failed to migrate %s: %s", path, err)
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.Warnf("failed to remove %s: %s", path, err)
+		return
+	}
+	log.Infof("moved %s to lab %s in %s", path, lab, statePath)
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const lockFileName = "lock"
+
+var (
+	lockMu    sync.Mutex
+	lockFile  *os.File
+	lockCount int
+)
+
+// Lock takes the advisory lock of the state directory, waiting for other ayame processes.
+// All the commands changing labs must hold it. It can be taken again in the same process.
+func Lock() error {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+
+	if lockCount > 0 {
+		lockCount++
+		return nil
+	}
+
+	if err := os.MkdirAll(statePath, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %s", statePath, err)
+	}
+
+	path := filepath.Join(statePath, lockFileName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %s", path, err)
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		if err != unix.EWOULDBLOCK {
+			f.Close()
+			return fmt.Errorf("failed to lock %s: %s", path, err)
+		}
+
+		log.Infof("waiting for another ayame holding %s", path)
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to lock %s: %s", path, err)
+		}
+	}
+
+	lockFile = f
+	lockCount = 1
+	return nil
+}
+
+// Unlock releases the lock taken by Lock.
+func Unlock() {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+
+	if lockCount == 0 {
+		return
+	}
+
+	lockCount--
+	if lockCount > 0 {
+		return
+	}
+
+	unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
+	lockFile.Close()
+	lockFile = nil
+}
@@ -0,0 +1,643 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+const (
+	ActionAdd    = "+"
+	ActionRemove = "-"
+	ActionModify = "~"
+)
+
+// Operation is an incremental change from the saved state to the config.
+type Operation struct {
+	Action   string
+	Resource string
+	Name     string
+	Detail   string
+	apply    func(ctx context.Context, s *State) error
+}
+
+func (o *Operation) String() string {
+	s := fmt.Sprintf("%s %s %s", o.Action, o.Resource, o.Name)
+	if o.Detail != "" {
+		s += " (" + o.Detail + ")"
+	}
+	return s
+}
+
+// Plan is a list of operations in the order to be applied.
+type Plan struct {
+	Operations []*Operation
+	config     *config.Config
+}
+
+func (p *Plan) String() string {
+	if len(p.Operations) == 0 {
+		return "No changes."
+	}
+
+	var lines []string
+	for _, op := range p.Operations {
+		lines = append(lines, op.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Apply performs the operations on the state. The operations done before a failure are kept in
+// the state, so it should be saved anyway. The failed one is rolled back.
+func (p *Plan) Apply(ctx context.Context, s *State) error {
+	if s.DirectLinks == nil {
+		s.DirectLinks = make(map[string]*network.DirectLink)
+	}
+	if s.Bridges == nil {
+		s.Bridges = make(map[string]*network.Bridge)
+	}
+
+	// Changes are journaled as in the creation, so that resources added by an apply
+	// which crashed are rolled back by the next apply or delete. The journal is removed
+	// when the state is saved.
+	var journal *Journal
+	if !network.IsHermetic(ctx) {
+		var err error
+		journal, err = OpenJournal(s.Lab)
+		if err != nil {
+			return err
+		}
+		defer journal.Close()
+
+		if journal.Pending() != 0 {
+			log.Infof("rollback interrupted changes to lab %s", s.Lab)
+			if err := journal.Rollback(network.WithoutCancel(ctx)); err != nil {
+				return err
+			}
+		}
+
+		ctx = network.WithRecorder(ctx, journal)
+	}
+
+	for _, op := range p.Operations {
+		// Operations done so far are kept in the state on interruption.
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("interrupted before %s: %s", op.String(), err)
+		}
+
+		log.Infof("apply %s", op.String())
+		if journal == nil {
+			if err := op.apply(ctx, s); err != nil {
+				return fmt.Errorf("failed to apply %s: %s", op.String(), err)
+			}
+			continue
+		}
+
+		// The operation changes the state before it makes the resources, so the state is
+		// restored as well when the resources are rolled back.
+		snapshot, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		mark := journal.mark()
+		if err := op.apply(ctx, s); err != nil {
+			err = fmt.Errorf("failed to apply %s: %s", op.String(), err)
+			log.Infof("rollback %s", op.String())
+			if rerr := journal.rollbackSince(network.WithoutCancel(ctx), mark); rerr != nil {
+				return multierr.Append(err, rerr)
+			}
+
+			var restored State
+			if rerr := json.Unmarshal(snapshot, &restored); rerr != nil {
+				return multierr.Append(err, rerr)
+			}
+			*s = restored
+			return err
+		}
+	}
+
+	s.Hooks = p.config.Hooks
+	s.Expectations = p.config.Expect
+	for _, nscfg := range p.config.Namespaces {
+		if n := s.FindNamespace(nscfg.Name); n != nil {
+			n.OnDelete = nscfg.OnDelete
+			n.DependsOn = nscfg.DependsOn
+			n.ReadyWhen = nscfg.ReadyWhen
+		}
+	}
+
+	return nil
+}
+
+type planner struct {
+	cfg  *config.Config
+	s    *State
+	plan *Plan
+
+	// namespaces whose routes must be added again because their devices change.
+	affected map[string]bool
+}
+
+// PlanResources computes the operations needed to make the saved state match the config.
+// Commands, services and ready_when probes only run in added namespaces.
+func PlanResources(cfg *config.Config, s *State) (*Plan, error) {
+	p := &planner{cfg: cfg, s: s, plan: &Plan{config: cfg}, affected: make(map[string]bool)}
+
+	links := make(map[string]*config.LinkConfig)
+	for _, link := range cfg.Links {
+		links[link.Name] = link
+	}
+
+	if err := p.validateDirectLinks(links); err != nil {
+		return nil, err
+	}
+
+	p.findAffected(links)
+
+	// Removal goes from the inside out, and addition goes the other way.
+	p.removeRoutes()
+	p.removeBridgeEndpoints(links)
+	recreated := p.removeDirectLinks(links)
+	p.removeBridges(links)
+	p.removeNamespaces()
+	p.addNamespaces()
+	p.addBridges(links)
+	p.addDirectLinks(links, recreated)
+	p.addBridgeEndpoints(links)
+	p.modifyAddresses(links)
+	p.addRoutes()
+
+	if err := p.startNamespaces(); err != nil {
+		return nil, err
+	}
+
+	return p.plan, nil
+}
+
+func (p *planner) add(action string, resource string, name string, detail string, apply func(ctx context.Context, s *State) error) {
+	p.plan.Operations = append(p.plan.Operations, &Operation{
+		Action:   action,
+		Resource: resource,
+		Name:     name,
+		Detail:   detail,
+		apply:    apply,
+	})
+}
+
+func (p *planner) namespaceConfig(name string) *config.NamespaceConfig {
+	for _, nscfg := range p.cfg.Namespaces {
+		if nscfg.Name == name {
+			return nscfg
+		}
+	}
+	return nil
+}
+
+func deviceConfig(nscfg *config.NamespaceConfig, device string) *config.NamespaceDeviceConfig {
+	for i := range nscfg.Devices {
+		if nscfg.Devices[i].Name == device {
+			return &nscfg.Devices[i]
+		}
+	}
+	return nil
+}
+
+func attachedDevice(n *network.Namespace, device string) *network.RegisteredDeviceConfig {
+	for i := range n.RegisteredDeviceConfig {
+		if n.RegisteredDeviceConfig[i].Name == device && len(n.RegisteredDeviceConfig[i].AttachedVeth) != 0 {
+			return &n.RegisteredDeviceConfig[i]
+		}
+	}
+	return nil
+}
+
+// currentEndpoints returns the names of the namespaces attached to the link in the state.
+func (p *planner) currentEndpoints(link string) []string {
+	var names []string
+	for _, n := range p.s.Namespaces {
+		if attachedDevice(n, link) != nil {
+			names = append(names, n.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// desiredEndpoints returns the names of the namespaces having the link in the config.
+func (p *planner) desiredEndpoints(link string) []string {
+	var names []string
+	for _, nscfg := range p.cfg.Namespaces {
+		if deviceConfig(nscfg, link) != nil {
+			names = append(names, nscfg.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *planner) wants(links map[string]*config.LinkConfig, name string, mode config.LinkMode) bool {
+	link, ok := links[name]
+	return ok && link.LinkMode == mode
+}
+
+func (p *planner) validateDirectLinks(links map[string]*config.LinkConfig) error {
+	for _, link := range p.cfg.Links {
+		if link.LinkMode != config.ModeDirectLink {
+			continue
+		}
+
+		if n := len(p.desiredEndpoints(link.Name)); n != 0 && n != 2 {
+			return fmt.Errorf("%s should have only 2 link", link.Name)
+		}
+	}
+	return nil
+}
+
+// directLinkChanged reports whether the saved direct link must be deleted.
+func (p *planner) directLinkChanged(links map[string]*config.LinkConfig, name string) bool {
+	if !p.wants(links, name, config.ModeDirectLink) {
+		return true
+	}
+
+	current := p.currentEndpoints(name)
+	desired := p.desiredEndpoints(name)
+	if strings.Join(current, ",") != strings.Join(desired, ",") {
+		return true
+	}
+
+	// Both of the ends are gone if one of the namespaces is deleted.
+	for _, name := range current {
+		if p.namespaceConfig(name) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *planner) findAffected(links map[string]*config.LinkConfig) {
+	for _, n := range p.s.Namespaces {
+		nscfg := p.namespaceConfig(n.Name)
+		if nscfg == nil {
+			continue
+		}
+
+		for _, dev := range n.RegisteredDeviceConfig {
+			if len(dev.AttachedVeth) == 0 {
+				continue
+			}
+
+			desired := deviceConfig(nscfg, dev.Name)
+			switch {
+			case desired == nil, desired.Cidr != dev.Cidr:
+				p.affected[n.Name] = true
+			case p.s.DirectLinks[dev.Name] != nil && p.directLinkChanged(links, dev.Name):
+				p.affected[n.Name] = true
+			case p.s.Bridges[dev.Name] != nil && !p.wants(links, dev.Name, config.ModeBridge):
+				p.affected[n.Name] = true
+			}
+		}
+	}
+}
+
+func routeIndex(routes []config.RouteConfig, route config.RouteConfig) int {
+	for i, r := range routes {
+		if r == route {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *planner) removeRoutes() {
+	for _, n := range p.s.Namespaces {
+		nscfg := p.namespaceConfig(n.Name)
+		if nscfg == nil {
+			continue
+		}
+
+		for _, route := range n.Routes {
+			if !p.affected[n.Name] && routeIndex(nscfg.Routes, route) != -1 {
+				continue
+			}
+
+			name, route := n.Name, route
+			p.add(ActionRemove, "route", name, route.String(), func(ctx context.Context, s *State) error {
+				return s.FindNamespace(name).DeleteRoute(ctx, route)
+			})
+		}
+	}
+}
+
+func (p *planner) addRoutes() {
+	for _, nscfg := range p.cfg.Namespaces {
+		n := p.s.FindNamespace(nscfg.Name)
+		if n == nil {
+			// Routes of added namespaces are added on startup.
+			continue
+		}
+
+		for _, route := range nscfg.Routes {
+			if !p.affected[n.Name] && routeIndex(n.Routes, route) != -1 {
+				continue
+			}
+
+			name, route := n.Name, route
+			p.add(ActionAdd, "route", name, route.String(), func(ctx context.Context, s *State) error {
+				return s.FindNamespace(name).AddRoute(ctx, route)
+			})
+		}
+	}
+}
+
+func sortedBridges(bridges map[string]*network.Bridge) []string {
+	var names []string
+	for name := range bridges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedDirectLinks(links map[string]*network.DirectLink) []string {
+	var names []string
+	for name := range links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *planner) removeBridgeEndpoints(links map[string]*config.LinkConfig) {
+	for _, br := range sortedBridges(p.s.Bridges) {
+		wanted := p.wants(links, br, config.ModeBridge)
+		desired := p.desiredEndpoints(br)
+
+		for _, name := range p.currentEndpoints(br) {
+			if wanted && contains(desired, name) {
+				continue
+			}
+
+			br, name := br, name
+			p.add(ActionRemove, "bridge_endpoint", br, name, func(ctx context.Context, s *State) error {
+				return s.Bridges[br].RemoveLink(ctx, s.FindNamespace(name))
+			})
+		}
+	}
+}
+
+func (p *planner) addBridgeEndpoints(links map[string]*config.LinkConfig) {
+	for _, link := range p.cfg.Links {
+		if link.LinkMode != config.ModeBridge {
+			continue
+		}
+
+		current := p.currentEndpoints(link.Name)
+		_, exists := p.s.Bridges[link.Name]
+		for _, name := range p.desiredEndpoints(link.Name) {
+			if exists && contains(current, name) {
+				continue
+			}
+
+			br, name := link.Name, name
+			dev := *deviceConfig(p.namespaceConfig(name), br)
+			p.add(ActionAdd, "bridge_endpoint", br, name+" "+dev.Cidr, func(ctx context.Context, s *State) error {
+				n := s.FindNamespace(name)
+				register(n, dev)
+				return s.Bridges[br].CreateLink(ctx, n)
+			})
+		}
+	}
+}
+
+// removeDirectLinks removes changed direct links, and returns the ones which are kept in the config.
+func (p *planner) removeDirectLinks(links map[string]*config.LinkConfig) map[string]bool {
+	recreated := make(map[string]bool)
+	for _, name := range sortedDirectLinks(p.s.DirectLinks) {
+		if !p.directLinkChanged(links, name) {
+			continue
+		}
+
+		if p.wants(links, name, config.ModeDirectLink) {
+			recreated[name] = true
+		}
+
+		name := name
+		p.add(ActionRemove, "direct_link", name, strings.Join(p.currentEndpoints(name), ", "), func(ctx context.Context, s *State) error {
+			if err := s.DirectLinks[name].RemoveLink(ctx, s.Namespaces); err != nil {
+				return err
+			}
+			delete(s.DirectLinks, name)
+			return nil
+		})
+	}
+	return recreated
+}
+
+func (p *planner) addDirectLinks(links map[string]*config.LinkConfig, recreated map[string]bool) {
+	for _, link := range p.cfg.Links {
+		if link.LinkMode != config.ModeDirectLink {
+			continue
+		}
+		if _, ok := p.s.DirectLinks[link.Name]; ok && !recreated[link.Name] {
+			continue
+		}
+
+		link := link
+		desired := p.desiredEndpoints(link.Name)
+		var devs []config.NamespaceDeviceConfig
+		for _, name := range desired {
+			devs = append(devs, *deviceConfig(p.namespaceConfig(name), link.Name))
+		}
+
+		p.add(ActionAdd, "direct_link", link.Name, strings.Join(desired, ", "), func(ctx context.Context, s *State) error {
+			dlink, err := network.InitDirectLink(ctx, link, s.Lab)
+			if err != nil {
+				return err
+			}
+			s.DirectLinks[link.Name] = dlink
+
+			if len(desired) == 0 {
+				return nil
+			}
+
+			left, right := s.FindNamespace(desired[0]), s.FindNamespace(desired[1])
+			register(left, devs[0])
+			register(right, devs[1])
+			return dlink.CreateLink(ctx, left, right)
+		})
+	}
+}
+
+func (p *planner) removeBridges(links map[string]*config.LinkConfig) {
+	for _, br := range sortedBridges(p.s.Bridges) {
+		if p.wants(links, br, config.ModeBridge) {
+			continue
+		}
+
+		br := br
+		p.add(ActionRemove, "bridge", br, "", func(ctx context.Context, s *State) error {
+			if err := s.Bridges[br].Destroy(ctx); err != nil {
+				return err
+			}
+			delete(s.Bridges, br)
+			return nil
+		})
+	}
+}
+
+func (p *planner) addBridges(links map[string]*config.LinkConfig) {
+	for _, link := range p.cfg.Links {
+		if link.LinkMode != config.ModeBridge {
+			continue
+		}
+		if _, ok := p.s.Bridges[link.Name]; ok {
+			continue
+		}
+
+		link := link
+		p.add(ActionAdd, "bridge", link.Name, "", func(ctx context.Context, s *State) error {
+			br, err := network.InitBridge(ctx, link, s.Lab)
+			if err != nil {
+				return err
+			}
+			s.Bridges[link.Name] = br
+			return nil
+		})
+	}
+}
+
+func (p *planner) removeNamespaces() {
+	for _, n := range p.s.Namespaces {
+		if p.namespaceConfig(n.Name) != nil {
+			continue
+		}
+
+		name := n.Name
+		p.add(ActionRemove, "namespace", name, "", func(ctx context.Context, s *State) error {
+			n := s.FindNamespace(name)
+			n.RunOnDeleteCommands(ctx, s.Namespaces)
+			if err := n.Destroy(ctx); err != nil {
+				return err
+			}
+
+			var nss []*network.Namespace
+			for _, other := range s.Namespaces {
+				if other != n {
+					nss = append(nss, other)
+				}
+			}
+			s.Namespaces = nss
+			return nil
+		})
+	}
+}
+
+func (p *planner) addNamespaces() {
+	for _, nscfg := range p.cfg.Namespaces {
+		if p.s.FindNamespace(nscfg.Name) != nil {
+			continue
+		}
+
+		nscfg := nscfg
+		p.add(ActionAdd, "namespace", nscfg.Name, "", func(ctx context.Context, s *State) error {
+			n, err := network.InitNamespace(ctx, nscfg, s.Lab)
+			if err != nil {
+				return err
+			}
+			s.Namespaces = append(s.Namespaces, n)
+			return nil
+		})
+	}
+}
+
+func (p *planner) modifyAddresses(links map[string]*config.LinkConfig) {
+	for _, n := range p.s.Namespaces {
+		nscfg := p.namespaceConfig(n.Name)
+		if nscfg == nil {
+			continue
+		}
+
+		for _, dev := range n.RegisteredDeviceConfig {
+			desired := deviceConfig(nscfg, dev.Name)
+			if len(dev.AttachedVeth) == 0 || desired == nil || desired.Cidr == dev.Cidr {
+				continue
+			}
+			// The address is assigned again when the link is created.
+			if p.s.DirectLinks[dev.Name] != nil && p.directLinkChanged(links, dev.Name) {
+				continue
+			}
+			if p.s.Bridges[dev.Name] != nil && !p.wants(links, dev.Name, config.ModeBridge) {
+				continue
+			}
+
+			name, device, cidr := n.Name, dev.Name, desired.Cidr
+			p.add(ActionModify, "address", name+"/"+device, dev.Cidr+" -> "+cidr, func(ctx context.Context, s *State) error {
+				return s.FindNamespace(name).ChangeCidr(ctx, device, cidr)
+			})
+		}
+	}
+}
+
+// startNamespaces runs commands and services of the added namespaces in the order of dependencies.
+func (p *planner) startNamespaces() error {
+	order, err := config.StartupOrder(p.cfg.Namespaces)
+	if err != nil {
+		return err
+	}
+
+	for _, nscfg := range order {
+		if p.s.FindNamespace(nscfg.Name) != nil {
+			continue
+		}
+		if len(nscfg.Commands) == 0 && len(nscfg.Routes) == 0 && len(nscfg.Services) == 0 && len(nscfg.ReadyWhen) == 0 {
+			continue
+		}
+
+		nscfg := nscfg
+		detail := fmt.Sprintf("%d commands, %d routes, %d services", len(nscfg.Commands), len(nscfg.Routes), len(nscfg.Services))
+		p.add(ActionAdd, "startup", nscfg.Name, detail, func(ctx context.Context, s *State) error {
+			return startNamespace(ctx, s.FindNamespace(nscfg.Name), nscfg, s.Namespaces, p.cfg.CommandFailurePolicy, s.logDir())
+		})
+	}
+	return nil
+}
+
+// register makes the device attachable with the address in the config.
+func register(n *network.Namespace, dev config.NamespaceDeviceConfig) {
+	for i := range n.RegisteredDeviceConfig {
+		if n.RegisteredDeviceConfig[i].Name == dev.Name {
+			n.RegisteredDeviceConfig[i].NamespaceDeviceConfig = dev
+			return
+		}
+	}
+	n.Register(dev)
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+// RestoreResources creates the resources of the saved lab again, e.g. after reboot.
+// Only resources which have gone are created, so it can be run again after a failure.
+// Commands and routes are run again in the namespaces created, and services which
+// aren't running are started. Hooks aren't run, since they are for the creation.
+// The state is saved with the new results.
+func RestoreResources(ctx context.Context, lab string) (*State, error) {
+	s, err := LoadResources(lab)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resources are journaled as in the creation, so that those created by a failed restore
+	// are rolled back, and those of an interrupted one by the next restore or delete.
+	var journal *Journal
+	if !network.IsHermetic(ctx) {
+		journal, err = OpenJournal(lab)
+		if err != nil {
+			return nil, err
+		}
+		defer journal.Close()
+
+		if journal.Pending() != 0 {
+			log.Infof("rollback interrupted changes to lab %s", lab)
+			if err := journal.Rollback(network.WithoutCancel(ctx)); err != nil {
+				return nil, err
+			}
+		}
+		ctx = network.WithRecorder(ctx, journal)
+	}
+
+	restarted, err := s.restoreResources(ctx)
+	if err != nil {
+		if journal == nil {
+			return nil, err
+		}
+		// The rollback must run to the end even if ctx has been cancelled.
+		if rerr := journal.Rollback(network.WithoutCancel(ctx)); rerr != nil {
+			log.Warnf("run `ayame delete --lab %s` to retry the rollback", lab)
+			return nil, multierr.Append(err, rerr)
+		}
+		if rerr := journal.Remove(); rerr != nil {
+			log.Warnf("failed to remove journal: %s", rerr)
+		}
+		return nil, err
+	}
+
+	order, err := s.startupOrder()
+	if err != nil {
+		return nil, err
+	}
+
+	// Failures of commands and services are reported after the state is saved,
+	// so that the lab can be inspected and deleted.
+	var allerr error
+	for _, ns := range order {
+		if err := ctx.Err(); err != nil {
+			allerr = multierr.Append(allerr, fmt.Errorf("interrupted before starting %s: %s", ns.Name, err))
+			break
+		}
+
+		if err := restartNamespace(ctx, ns, s.Namespaces, restarted[ns.Name]); err != nil {
+			allerr = multierr.Append(allerr, err)
+		}
+	}
+
+	if err := s.SaveState(); err != nil {
+		return nil, multierr.Append(allerr, err)
+	}
+
+	return s, allerr
+}
+
+// restoreResources creates the namespaces, links and bridges which have gone.
+// It returns the namespaces created, whose commands are run again.
+func (s *State) restoreResources(ctx context.Context) (map[string]bool, error) {
+	restarted := make(map[string]bool)
+	for _, ns := range s.Namespaces {
+		created, err := ns.Restore(ctx)
+		if err != nil {
+			return nil, err
+		}
+		restarted[ns.Name] = created
+	}
+
+	// Links are restored in the order of names, so that the veths are created in the same order.
+	var links []string
+	for name := range s.DirectLinks {
+		links = append(links, name)
+	}
+	sort.Strings(links)
+	for _, name := range links {
+		if err := s.DirectLinks[name].Restore(ctx, s.Namespaces); err != nil {
+			return nil, err
+		}
+	}
+
+	var bridges []string
+	for name := range s.Bridges {
+		bridges = append(bridges, name)
+	}
+	sort.Strings(bridges)
+	for _, name := range bridges {
+		if err := s.Bridges[name].Restore(ctx, s.Namespaces); err != nil {
+			return nil, err
+		}
+	}
+
+	return restarted, nil
+}
+
+// startupOrder sorts the namespaces by depends_on in the same way as the creation.
+func (s *State) startupOrder() ([]*network.Namespace, error) {
+	var configs []*config.NamespaceConfig
+	for _, ns := range s.Namespaces {
+		configs = append(configs, &config.NamespaceConfig{Name: ns.Name, DependsOn: ns.DependsOn})
+	}
+
+	sorted, err := config.StartupOrder(configs)
+	if err != nil {
+		return nil, err
+	}
+
+	var order []*network.Namespace
+	for _, cfg := range sorted {
+		order = append(order, s.FindNamespace(cfg.Name))
+	}
+	return order, nil
+}
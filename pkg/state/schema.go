@@ -0,0 +1,123 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// SchemaVersion is the version of the state file written by this version of ayame.
+// Bump it with a migration whenever the saved fields change incompatibly.
+const SchemaVersion = 1
+
+// Metadata tells where the state came from.
+type Metadata struct {
+	AyameVersion string     `json:"ayame_version,omitempty"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+	// ConfigHash is the sha256 of the config which the lab was created or applied with.
+	ConfigHash string `json:"config_hash,omitempty"`
+	ConfigPath string `json:"config_path,omitempty"`
+}
+
+// SetSource records the config which the lab was created or applied with.
+func (s *State) SetSource(path string, config []byte) {
+	if s.Metadata == nil {
+		s.Metadata = &Metadata{}
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	sum := sha256.Sum256(config)
+
+	s.Metadata.ConfigPath = path
+	s.Metadata.ConfigHash = hex.EncodeToString(sum[:])
+}
+
+// SchemaVersionError is returned if the state was saved by a newer version of ayame.
+type SchemaVersionError struct {
+	Version int
+}
+
+func (e *SchemaVersionError) Error() string {
+	return fmt.Sprintf("schema version %d is newer than %d supported by this ayame, upgrade ayame", e.Version, SchemaVersion)
+}
+
+type migration func(raw map[string]interface{}) error
+
+// migrations[i] migrates the state from version i to i+1.
+var migrations = []migration{
+	migrateToV1,
+}
+
+// migrateState converts the state saved by older versions to SchemaVersion.
+func migrateState(bytes []byte) ([]byte, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(bytes, &raw); err != nil {
+		return nil, err
+	}
+
+	version := 0
+	if v, ok := raw["schema_version"]; ok {
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid schema_version %v", v)
+		}
+		version = int(f)
+	}
+
+	if version > SchemaVersion {
+		return nil, &SchemaVersionError{Version: version}
+	}
+	if version == SchemaVersion {
+		return bytes, nil
+	}
+
+	for ; version < SchemaVersion; version++ {
+		if err := migrations[version](raw); err != nil {
+			return nil, fmt.Errorf("failed to migrate from schema version %d: %s", version, err)
+		}
+	}
+	raw["schema_version"] = SchemaVersion
+
+	return json.Marshal(raw)
+}
+
+// migrateToV1 converts the state saved before labs were introduced, which doesn't have
+// schema_version. Its namespaces were created with their names in the config without
+// the lab, and the veths were named without the prefix of the lab, which is still the
+// case for states without the lab.
+func migrateToV1(raw map[string]interface{}) error {
+	nss, ok := raw["namespaces"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	for _, v := range nss {
+		ns, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid namespace %v", v)
+		}
+		if _, ok := ns["netns"]; !ok {
+			ns["netns"] = ns["name"]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// legacyState is saved by the versions before labs were introduced.
+const legacyState = `{
+  "direct_links": {
+    "veth1": {
+      "veth_pair": {
+        "veth_left": {"name": "veth1-left", "attached": true},
+        "veth_right": {"name": "veth1-right", "attached": true}
+      },
+      "name": "veth1"
+    }
+  },
+  "bridges": {},
+  "namespaces": [
+    {
+      "name": "ns1",
+      "registered_device_config": [
+        {"device_config": {"Name": "veth1", "Cidr": "192.168.100.10/24"}, "attached_veth": "veth1-left"}
+      ]
+    }
+  ]
+}`
+
+func TestLoadLegacyState(t *testing.T) {
+	s, err := LoadStateFromBytes([]byte(legacyState))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.SchemaVersion != SchemaVersion {
+		t.Errorf("expected schema version %d, actual %d", SchemaVersion, s.SchemaVersion)
+	}
+	if netns := s.Namespaces[0].NetnsName(); netns != "ns1" {
+		t.Errorf("expected netns ns1, actual %s", netns)
+	}
+	if veth := s.DirectLinks["veth1"].VethPair.Left.Name; veth != "veth1-left" {
+		t.Errorf("expected veth veth1-left, actual %s", veth)
+	}
+}
+
+func TestCorruptState(t *testing.T) {
+	useStateDir(t)
+
+	path := stateFile("test")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadResources("test")
+	if _, ok := err.(*CorruptStateError); !ok {
+		t.Fatalf("expected CorruptStateError, actual %v", err)
+	}
+	if strings.Contains(err.Error(), backupSuffix) {
+		t.Errorf("backup is suggested though it doesn't exist: %s", err)
+	}
+
+	if err := ioutil.WriteFile(path+backupSuffix, []byte(legacyState), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadResources("test")
+	if err == nil || !strings.Contains(err.Error(), path+backupSuffix) {
+		t.Errorf("backup is not suggested: %v", err)
+	}
+}
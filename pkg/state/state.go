@@ -15,46 +15,160 @@
 package state
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/Shikugawa/ayame/pkg/config"
 	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/version"
 	log "github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
 )
 
 type State struct {
+	SchemaVersion int       `json:"schema_version"`
+	Metadata      *Metadata `json:"metadata,omitempty"`
+	// Lab is the name of the lab, which the state file and kernel resources are named after.
+	Lab         string                         `json:"lab"`
 	DirectLinks map[string]*network.DirectLink `json:"direct_links"`
 	Bridges     map[string]*network.Bridge     `json:"bridges"`
 	Namespaces  []*network.Namespace           `json:"namespaces"`
+	Hooks       config.HooksConfig             `json:"hooks"`
+	// Expectations are evaluated by `ayame ping --all`.
+	Expectations []config.ExpectConfig `json:"expectations,omitempty"`
 }
 
-var statePath = os.Getenv("HOME") + "/.ayame"
+// ErrNoResources is returned if the state of the lab doesn't exist.
+var ErrNoResources = errors.New("no resources")
 
-const stateFileName = "state.json"
+// CorruptStateError is returned if the state file exists but can't be parsed.
+type CorruptStateError struct {
+	Path string
+	Err  error
+	// Backup is the previous state, or empty if it doesn't exist.
+	Backup string
+}
+
+func (e *CorruptStateError) Error() string {
+	if e.Backup == "" {
+		return fmt.Sprintf("state file %s is corrupt: %s", e.Path, e.Err)
+	}
+	return fmt.Sprintf("state file %s is corrupt: %s. The previous state may be in %s", e.Path, e.Err, e.Backup)
+}
+
+const (
+	stateFileName = "state.json"
+	backupSuffix  = ".bak"
+	logDirName    = "logs"
+	labsDirName   = "labs"
+)
+
+// labDir is the directory of the state file and logs of the lab.
+func labDir(lab string) string {
+	return filepath.Join(statePath, labsDirName, lab)
+}
+
+func stateFile(lab string) string {
+	return filepath.Join(labDir(lab), stateFileName)
+}
 
+func (s *State) logDir() string {
+	return filepath.Join(labDir(s.Lab), logDirName)
+}
+
+// SaveState writes the state atomically. The previous state is kept as a backup.
 func (s *State) SaveState() error {
+	if s.Metadata == nil {
+		s.Metadata = &Metadata{}
+	}
+
+	now := time.Now()
+	if s.Metadata.CreatedAt == nil {
+		s.Metadata.CreatedAt = &now
+	}
+	s.Metadata.UpdatedAt = &now
+	s.Metadata.AyameVersion = version.String()
+	s.SchemaVersion = SchemaVersion
+
 	b, err := json.Marshal(s)
 	if err != nil {
 		return err
 	}
-	if _, err := os.Stat(statePath); os.IsNotExist(err) {
-		if err := os.MkdirAll(statePath, 0644); err != nil {
-			return fmt.Errorf("failed to create %s", statePath)
+
+	dir := labDir(s.Lab)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %s", dir, err)
 		}
 	}
 
-	if err := ioutil.WriteFile(statePath+"/"+stateFileName, b, 0644); err != nil {
-		return err
+	path := stateFile(s.Lab)
+	if old, err := ioutil.ReadFile(path); err == nil {
+		if err := writeFileAtomic(path+backupSuffix, old); err != nil {
+			return fmt.Errorf("failed to back up %s: %s", path, err)
+		}
 	}
 
+	if err := writeFileAtomic(path, b); err != nil {
+		return fmt.Errorf("failed to save %s: %s", path, err)
+	}
+
+	// Changes journaled so far are committed to the state, and failures before are stale.
+	for _, done := range []string{journalFile(s.Lab), failedRunFile(s.Lab)} {
+		if err := os.Remove(done); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %s", done, err)
+		}
+	}
+
+	fixOwnership(dir)
+
 	log.Info("succeeded to save state")
 
 	return nil
 }
 
+// writeFileAtomic writes the data to a temporary file, and renames it to the path,
+// so that the file is never left half-written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself.
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
 func (s *State) DumpAll() (string, error) {
 	b, err := json.MarshalIndent(s, "", "  ")
 	if err != nil {
@@ -63,126 +177,361 @@ func (s *State) DumpAll() (string, error) {
 	return string(b), nil
 }
 
-func ResourcesSaved() bool {
-	if _, err := os.Stat(statePath + "/" + stateFileName); os.IsNotExist(err) {
+// RefreshServices fills the current status of all the services.
+func (s *State) RefreshServices() {
+	for _, n := range s.Namespaces {
+		n.RefreshServices()
+	}
+}
+
+func ResourcesSaved(lab string) bool {
+	if _, err := os.Stat(stateFile(lab)); os.IsNotExist(err) {
 		return false
 	}
 	return true
 }
 
-func LoadResources() *State {
-	if !ResourcesSaved() {
-		return nil
+// LoadResources loads the state of the lab. It returns ErrNoResources if the state doesn't exist,
+// and CorruptStateError if it can't be parsed.
+func LoadResources(lab string) (*State, error) {
+	migrateLegacyStates()
+
+	path := stateFile(lab)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNoResources
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", path, err)
 	}
 
-	b, err := ioutil.ReadFile(statePath + "/" + stateFileName)
+	state, err := LoadStateFromBytes(b)
+	if _, ok := err.(*SchemaVersionError); ok {
+		return nil, fmt.Errorf("failed to load %s: %s", path, err)
+	}
 	if err != nil {
-		return nil
+		corrupt := &CorruptStateError{Path: path, Err: err}
+		if _, err := os.Stat(path + backupSuffix); err == nil {
+			corrupt.Backup = path + backupSuffix
+		}
+		return nil, corrupt
 	}
 
-	return LoadStateFromBytes(b)
+	return state, nil
 }
 
-func LoadStateFromBytes(bytes []byte) *State {
+// LoadStateFromBytes parses the state, migrating it from older schema versions.
+func LoadStateFromBytes(bytes []byte) (*State, error) {
+	bytes, err := migrateState(bytes)
+	if err != nil {
+		return nil, err
+	}
+
 	var state State
 	if err := json.Unmarshal(bytes, &state); err != nil {
-		return nil
+		return nil, err
 	}
 
-	return &state
+	return &state, nil
 }
 
-func DisposeResources() error {
-	state := LoadResources()
-	if state == nil {
-		return fmt.Errorf("resources have already cleared.")
+// DisposeResources deletes the lab. An interrupted creation is rolled back by the journal,
+// and an interrupted deletion resumes after the phases which have completed.
+func DisposeResources(ctx context.Context, lab string) error {
+	state, err := LoadResources(lab)
+	if err == ErrNoResources {
+		if !journalExists(lab) {
+			return fmt.Errorf("resources have already cleared.")
+		}
+		return rollbackResources(ctx, lab)
+	}
+	if err != nil {
+		return err
+	}
+
+	journal, err := OpenJournal(lab)
+	if err != nil {
+		return err
+	}
+
+	if err := disposeResources(ctx, state, journal); err != nil {
+		journal.Close()
+		return err
 	}
+	journal.Close()
 
-	if err := network.CleanupDirectLinks(state.DirectLinks, false); err != nil {
+	// Logs of services are removed together.
+	if err := os.RemoveAll(labDir(lab)); err != nil {
 		return err
 	}
-	if err := network.CleanupBridges(state.Bridges, false); err != nil {
+	return nil
+}
+
+func rollbackResources(ctx context.Context, lab string) error {
+	journal, err := OpenJournal(lab)
+	if err != nil {
 		return err
 	}
-	if err := network.CleanupNamespaces(state.Namespaces, false); err != nil {
+
+	log.Infof("rollback interrupted creation of lab %s", lab)
+	if err := journal.Rollback(ctx); err != nil {
+		journal.Close()
 		return err
 	}
+	journal.Close()
 
-	if err := os.Remove(statePath + "/" + stateFileName); err != nil {
+	if err := os.RemoveAll(labDir(lab)); err != nil {
 		return err
 	}
 	return nil
 }
 
-// TODO: consider error handling
-func InitResources(cfg *config.Config, dryrun bool) (*State, error) {
-	state := LoadResources()
-	if state != nil {
-		return nil, fmt.Errorf("resources have already existed.")
+func disposeResources(ctx context.Context, state *State, journal *Journal) error {
+	phases := []struct {
+		name string
+		run  func() error
+	}{
+		{phasePreDelete, func() error {
+			// Hooks on deletion must not block the teardown.
+			if _, err := network.RunHostCommands(ctx, state.Hooks.PreDelete, config.PolicyContinue); err != nil {
+				log.Warnf("some pre_delete hooks failed")
+			}
+			return nil
+		}},
+		{phaseOnDelete, func() error {
+			network.RunNamespacesOnDeleteCommands(ctx, state.Namespaces)
+			return nil
+		}},
+		{phaseLinks, func() error {
+			return network.CleanupDirectLinks(ctx, state.DirectLinks)
+		}},
+		{phaseBridges, func() error {
+			return network.CleanupBridges(ctx, state.Bridges)
+		}},
+		{phaseNamespaces, func() error {
+			return network.CleanupNamespaces(ctx, state.Namespaces)
+		}},
 	}
 
-	state = &State{Namespaces: nil, DirectLinks: nil, Bridges: nil}
+	for _, phase := range phases {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("interrupted before %s, run delete again to resume: %s", phase.name, err)
+		}
+		if journal.done(phase.name) {
+			log.Infof("skip %s which has completed", phase.name)
+			continue
+		}
+		if err := phase.run(); err != nil {
+			return err
+		}
+		if err := journal.markDone(phase.name); err != nil {
+			return err
+		}
+	}
 
-	cleanup := func(links map[string]*network.DirectLink, bridges map[string]*network.Bridge,
-		nss []*network.Namespace, dryrun bool) {
-		if links != nil {
-			network.CleanupDirectLinks(links, dryrun)
+	// Resources added by an apply which crashed aren't in the state.
+	if journal.Pending() != 0 {
+		log.Infof("rollback interrupted changes to lab %s", state.Lab)
+		if err := journal.Rollback(ctx); err != nil {
+			return err
 		}
+	}
 
-		if bridges != nil {
-			network.CleanupBridges(bridges, dryrun)
+	if _, err := network.RunHostCommands(ctx, state.Hooks.PostDelete, config.PolicyContinue); err != nil {
+		log.Warnf("some post_delete hooks failed")
+	}
+
+	return nil
+}
+
+// FindNamespace returns the saved namespace, or nil if it doesn't exist.
+func (s *State) FindNamespace(name string) *network.Namespace {
+	return findNamespace(s.Namespaces, name)
+}
+
+func findNamespace(nss []*network.Namespace, name string) *network.Namespace {
+	for _, n := range nss {
+		if n.Name == name {
+			return n
 		}
+	}
+	return nil
+}
 
-		if nss != nil {
-			network.CleanupNamespaces(nss, dryrun)
+// startNamespace runs commands, adds routes, starts services and waits for the namespace to get ready.
+func startNamespace(ctx context.Context, n *network.Namespace, nscfg *config.NamespaceConfig, peers []*network.Namespace,
+	policy config.CommandFailurePolicy, logDir string) error {
+	// Run Commands inside namespaces
+	if err := n.RunCommands(ctx, nscfg.Commands, peers, policy); err != nil {
+		if policy == config.PolicyAbort {
+			return err
 		}
+		log.Warnf("some commands failed in %s", n.Name)
 	}
 
-	// Init links
-	dlinks, err := network.InitDirectLinks(cfg.Links, dryrun)
-	if err != nil {
-		return nil, err
+	for _, route := range nscfg.Routes {
+		if err := n.AddRoute(ctx, route); err != nil {
+			return err
+		}
 	}
 
-	// Init Bridges
-	brs, err := network.InitBridges(cfg.Links, dryrun)
-	if err != nil {
-		cleanup(dlinks, nil, nil, dryrun)
+	// Start services inside namespaces
+	if err := n.StartServices(ctx, nscfg.Services, peers, logDir); err != nil {
+		return err
+	}
+
+	if err := n.WaitReady(ctx, nscfg.ReadyWhen, peers); err != nil {
+		if policy == config.PolicyAbort {
+			return err
+		}
+		log.Warnf(err.Error())
+	}
+
+	return nil
+}
+
+// restartNamespace starts the restored namespace in the same way as startNamespace. The commands
+// and routes run again only if the namespace has been created again, and only the services which
+// aren't running are started. Failures don't stop the others.
+func restartNamespace(ctx context.Context, n *network.Namespace, peers []*network.Namespace, created bool) error {
+	var allerr error
+	if created {
+		if err := n.Restart(ctx, peers); err != nil {
+			allerr = multierr.Append(allerr, err)
+		}
+	}
+
+	if err := n.RestartServices(ctx, peers); err != nil {
+		allerr = multierr.Append(allerr, err)
+	}
+
+	// Namespaces depending on this one start after it, even if it isn't ready.
+	if err := n.WaitReady(ctx, n.ReadyWhen, peers); err != nil {
+		allerr = multierr.Append(allerr, err)
+	}
+
+	return allerr
+}
+
+func InitResources(ctx context.Context, cfg *config.Config, lab string) (*State, error) {
+	if err := config.ValidateLabName(lab); err != nil {
 		return nil, err
 	}
 
-	// Init namespaces
-	ns, err := network.InitNamespaces(cfg.Namespaces, dryrun)
+	// Dry runs and fakes don't touch the saved labs, so they can render a lab which exists.
+	if !network.IsHermetic(ctx) {
+		_, err := LoadResources(lab)
+		if err == nil {
+			return nil, fmt.Errorf("resources of lab %s have already existed.", lab)
+		}
+		if err != ErrNoResources {
+			return nil, err
+		}
+
+		if err := CheckLabPrefix(lab); err != nil {
+			return nil, err
+		}
+	}
+
+	state := &State{SchemaVersion: SchemaVersion, Lab: lab, Namespaces: nil, DirectLinks: nil, Bridges: nil, Hooks: cfg.Hooks, Expectations: cfg.Expect}
+
+	// Every change to the kernel is journaled, so that it can be rolled back exactly
+	// on failures, or by `ayame delete` after a crash.
+	var journal *Journal
+	switch {
+	case network.IsDryRun(ctx):
+		// Steps of dry runs are left to the recorder of the caller.
+	case network.IsHermetic(ctx):
+		journal = newMemoryJournal()
+	default:
+		if journalExists(lab) {
+			return nil, fmt.Errorf("creation of lab %s was interrupted. run `ayame delete --lab %s` to roll it back", lab, lab)
+		}
+
+		var err error
+		journal, err = OpenJournal(lab)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if journal != nil {
+		ctx = network.WithRecorder(ctx, journal)
+	}
+
+	cleanup := func() {
+		if journal == nil {
+			return
+		}
+
+		// The rollback must run to the end even if ctx has been cancelled.
+		if err := journal.Rollback(network.WithoutCancel(ctx)); err != nil {
+			log.Warnf(err.Error())
+			log.Warnf("run `ayame delete --lab %s` to retry the rollback", lab)
+			journal.Close()
+			return
+		}
+		if err := journal.Remove(); err != nil {
+			log.Warnf("failed to remove journal: %s", err)
+		}
+	}
+
+	// The outputs of the commands are recorded before the rollback deletes their namespaces.
+	var hookResults []network.CommandResult
+	fail := func(err error, ns []*network.Namespace) error {
+		if !network.IsHermetic(ctx) {
+			if path, serr := saveFailedRun(lab, err, hookResults, ns); serr != nil {
+				log.Warnf("failed to record the failed run: %s", serr)
+			} else {
+				log.Errorf("outputs of the commands are recorded in %s", path)
+			}
+		}
+		cleanup()
+		return err
+	}
+
+	results, err := network.RunHostCommands(ctx, cfg.Hooks.PreCreate, cfg.CommandFailurePolicy)
+	hookResults = append(hookResults, results...)
 	if err != nil {
-		cleanup(dlinks, brs, nil, dryrun)
-		return nil, err
+		if cfg.CommandFailurePolicy == config.PolicyAbort {
+			return nil, fail(err, nil)
+		}
+		log.Warnf("some pre_create hooks failed")
 	}
 
-	// Link (Direct Links) Namespaces
-	if err := network.InitNamespacesLinks(ns, dlinks, dryrun); err != nil {
-		cleanup(dlinks, brs, ns, dryrun)
+	b, err := newBuild(cfg, lab, state.logDir())
+	if err != nil {
+		cleanup()
 		return nil, err
 	}
 
-	// Link (Bridges) Namespaces
-	if err := network.InitNamespacesBridges(ns, brs, dryrun); err != nil {
-		cleanup(dlinks, brs, ns, dryrun)
-		return nil, err
+	if err := b.run(ctx, network.Parallelism(ctx)); err != nil {
+		_, _, ns := b.created()
+		if b.started() {
+			network.RunNamespacesOnDeleteCommands(network.WithoutCancel(ctx), ns)
+		}
+		return nil, fail(err, ns)
 	}
 
-	// Run Commands inside namespaces
-	for _, n := range ns {
-		// TODO: dirty
-		for _, nscfg := range cfg.Namespaces {
-			if n.Name == nscfg.Name {
-				n.RunCommands(nscfg.Commands, dryrun)
-			}
+	dlinks, brs, ns := b.created()
+
+	results, err = network.RunHostCommands(ctx, cfg.Hooks.PostCreate, cfg.CommandFailurePolicy)
+	hookResults = append(hookResults, results...)
+	if err != nil {
+		if cfg.CommandFailurePolicy == config.PolicyAbort {
+			network.RunNamespacesOnDeleteCommands(network.WithoutCancel(ctx), ns)
+			return nil, fail(err, ns)
 		}
+		log.Warnf("some post_create hooks failed")
 	}
 
 	state.DirectLinks = dlinks
 	state.Bridges = brs
 	state.Namespaces = ns
 
+	// The journal is removed when the state is saved.
+	if journal != nil {
+		journal.Close()
+	}
+
 	return state, nil
 }
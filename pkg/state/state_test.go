@@ -0,0 +1,489 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	os.Exit(m.Run())
+}
+
+const twoNamespacesConfig = `
+links:
+  - name: veth1
+    mode: direct_link
+namespaces:
+  - name: ns1
+    devices:
+      - name: veth1
+        cidr: 10.0.0.1/24
+    commands:
+      - ip link set $(veth1) up
+  - name: ns2
+    devices:
+      - name: veth1
+        cidr: 10.0.0.2/24
+    commands:
+      - ip link set $(veth1) up
+`
+
+// fakeHost keeps the namespaces and veths made by the commands, and answers the
+// commands inspecting them, so that rollbacks and deletes see what has been created.
+// The command equal to fail exits with 1.
+type fakeHost struct {
+	mu    sync.Mutex
+	netns map[string]bool
+	// links maps the veths to their namespaces, which are empty on the host.
+	links map[string]string
+	peers map[string]string
+	addrs map[string][]string
+	up    map[string]bool
+	fail  string
+}
+
+func newFakeExecutor(h *fakeHost) *network.FakeExecutor {
+	return &network.FakeExecutor{Respond: h.respond}
+}
+
+func (h *fakeHost) deleteLink(name string) {
+	for _, n := range []string{name, h.peers[name]} {
+		delete(h.links, n)
+		delete(h.addrs, n)
+		delete(h.up, n)
+	}
+}
+
+// addrJSON answers `ip -j addr show` in the namespace.
+func (h *fakeHost) addrJSON(nsname string) string {
+	var entries []string
+	for _, name := range sortedKeys(h.linksIn(nsname)) {
+		var infos []string
+		for _, cidr := range h.addrs[name] {
+			parts := strings.Split(cidr, "/")
+			infos = append(infos, fmt.Sprintf(`{"local":%q,"prefixlen":%s}`, parts[0], parts[1]))
+		}
+		flags := ""
+		if h.up[name] {
+			flags = `"UP"`
+		}
+		entries = append(entries, fmt.Sprintf(`{"ifname":%q,"flags":[%s],"addr_info":[%s]}`, name, flags, strings.Join(infos, ",")))
+	}
+	return "[" + strings.Join(entries, ",") + "]"
+}
+
+func (h *fakeHost) linksIn(nsname string) map[string]bool {
+	links := make(map[string]bool)
+	for name, ns := range h.links {
+		if ns == nsname {
+			links[name] = true
+		}
+	}
+	return links
+}
+
+func (h *fakeHost) respond(cmd *network.Command) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.netns == nil {
+		h.netns = make(map[string]bool)
+		h.links = make(map[string]string)
+		h.peers = make(map[string]string)
+		h.addrs = make(map[string][]string)
+		h.up = make(map[string]bool)
+	}
+
+	if h.fail != "" && cmd.String() == h.fail {
+		return "", &network.ExitError{Code: 1}
+	}
+
+	a := cmd.Args
+	if cmd.Name != "ip" {
+		return "", nil
+	}
+
+	jsonOutput := len(a) != 0 && a[0] == "-j"
+	if jsonOutput {
+		a = a[1:]
+	}
+
+	// Commands in a namespace are handled like the ones with -n.
+	nsname := ""
+	if len(a) > 4 && a[0] == "netns" && a[1] == "exec" && a[3] == "ip" {
+		nsname, a = a[2], a[4:]
+	} else if len(a) > 2 && a[0] == "-n" {
+		nsname, a = a[1], a[2:]
+	}
+
+	switch {
+	case len(a) == 3 && a[0] == "netns" && a[1] == "add":
+		h.netns[a[2]] = true
+	case len(a) == 3 && a[0] == "netns" && a[1] == "delete":
+		delete(h.netns, a[2])
+		for name, ns := range h.links {
+			if ns == a[2] {
+				h.deleteLink(name)
+			}
+		}
+	case len(a) == 2 && a[0] == "netns" && a[1] == "list":
+		var names []string
+		for name := range h.netns {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, "\n"), nil
+	case len(a) == 8 && a[0] == "link" && a[1] == "add":
+		h.links[a[3]], h.links[a[7]] = "", ""
+		h.peers[a[3]], h.peers[a[7]] = a[7], a[3]
+	case len(a) == 5 && a[0] == "link" && a[1] == "set" && a[3] == "netns":
+		if a[4] == "1" {
+			h.links[a[2]] = ""
+		} else {
+			h.links[a[2]] = a[4]
+		}
+	case len(a) == 4 && a[0] == "link" && a[1] == "set" && (a[3] == "up" || a[3] == "down"):
+		h.up[a[2]] = a[3] == "up"
+	case len(a) == 3 && a[0] == "link" && a[1] == "delete":
+		h.deleteLink(a[2])
+	case len(a) == 5 && a[0] == "addr" && a[1] == "add":
+		h.addrs[a[4]] = append(h.addrs[a[4]], a[2])
+	case len(a) == 5 && a[0] == "addr" && a[1] == "del":
+		var addrs []string
+		for _, cidr := range h.addrs[a[4]] {
+			if cidr != a[2] {
+				addrs = append(addrs, cidr)
+			}
+		}
+		h.addrs[a[4]] = addrs
+	case jsonOutput && len(a) == 3 && a[0] == "-d" && a[1] == "addr":
+		return h.addrJSON(nsname), nil
+	case jsonOutput:
+		return "[]", nil
+	case len(a) == 4 && a[0] == "link" && a[1] == "show":
+		if ns, ok := h.links[a[3]]; !ok || ns != nsname {
+			return "", &network.ExitError{Code: 1, Stderr: "Device does not exist."}
+		}
+	}
+	return "", nil
+}
+
+func parseConfig(t *testing.T, s string) *config.Config {
+	t.Helper()
+
+	cfg, err := config.ParseConfig([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func assertTranscript(t *testing.T, e *network.FakeExecutor, expected []string) {
+	t.Helper()
+
+	actual := e.Transcript()
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		var want, got string
+		if i < len(expected) {
+			want = expected[i]
+		}
+		if i < len(actual) {
+			got = actual[i]
+		}
+		if want != got {
+			t.Errorf("command %d: expected %q, actual %q", i+1, want, got)
+		}
+	}
+}
+
+// useStateDir points the state to a temporary directory during the test.
+func useStateDir(t *testing.T) string {
+	t.Helper()
+
+	prev := StateDir()
+	dir := t.TempDir()
+	SetStateDir(dir)
+	t.Cleanup(func() { SetStateDir(prev) })
+	return dir
+}
+
+var createCommands = []string{
+	"ip link add name 71e5-veth1-l type veth peer 71e5-veth1-r",
+	"ip link set dev 71e5-veth1-l alias ayame",
+	"ip link set dev 71e5-veth1-r alias ayame",
+	"ip netns add ayame-test-ns1",
+	"ip netns add ayame-test-ns2",
+	"ip link set 71e5-veth1-l netns ayame-test-ns1",
+	"ip netns exec ayame-test-ns1 ip addr add 10.0.0.1/24 dev 71e5-veth1-l",
+	"ip link set 71e5-veth1-r netns ayame-test-ns2",
+	"ip netns exec ayame-test-ns2 ip addr add 10.0.0.2/24 dev 71e5-veth1-r",
+	"ip netns exec ayame-test-ns1 ip link set 71e5-veth1-l up",
+	"ip netns exec ayame-test-ns2 ip link set 71e5-veth1-r up",
+}
+
+func TestInitResources(t *testing.T) {
+	dir := useStateDir(t)
+	e := newFakeExecutor(&fakeHost{})
+
+	s, err := InitResources(network.WithExecutor(context.Background(), e), parseConfig(t, twoNamespacesConfig), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertTranscript(t, e, createCommands)
+
+	for _, ns := range s.Namespaces {
+		if ns.RegisteredDeviceConfig[0].AttachedVeth == "" {
+			t.Errorf("veth1 is not attached to %s", ns.Name)
+		}
+		if len(ns.CommandResults) != 1 || ns.CommandResults[0].ExitCode != 0 {
+			t.Errorf("unexpected command results of %s: %+v", ns.Name, ns.CommandResults)
+		}
+	}
+
+	// Nothing is written by the flows with the fake.
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d files are written to the state directory", len(files))
+	}
+}
+
+func TestInitResourcesRollback(t *testing.T) {
+	useStateDir(t)
+	h := &fakeHost{fail: "ip netns exec ayame-test-ns2 ip link set 71e5-veth1-r up"}
+	e := newFakeExecutor(h)
+
+	_, err := InitResources(network.WithExecutor(context.Background(), e), parseConfig(t, twoNamespacesConfig), "test")
+	if err == nil {
+		t.Fatal("expected the failed command to abort the creation")
+	}
+
+	// The changes are undone in the reverse order. The veths are deleted together
+	// with the namespaces, so they are skipped on the host.
+	expected := append(append([]string(nil), createCommands...),
+		"ip netns list",
+		"ip -n ayame-test-ns2 link show dev 71e5-veth1-r",
+		"ip -j -n ayame-test-ns2 -d addr show",
+		"ip netns exec ayame-test-ns2 ip addr del 10.0.0.2/24 dev 71e5-veth1-r",
+		"ip netns list",
+		"ip -n ayame-test-ns2 link show dev 71e5-veth1-r",
+		"ip netns exec ayame-test-ns2 ip link delete 71e5-veth1-r",
+		"ip netns list",
+		"ip -n ayame-test-ns1 link show dev 71e5-veth1-l",
+		"ip netns list",
+		"ip -n ayame-test-ns1 link show dev 71e5-veth1-l",
+		"ip netns list",
+		"ip netns delete ayame-test-ns2",
+		"ip netns list",
+		"ip netns delete ayame-test-ns1",
+		"ip link show dev 71e5-veth1-l",
+	)
+	assertTranscript(t, e, expected)
+
+	if len(h.netns) != 0 || len(h.links) != 0 {
+		t.Errorf("resources are left: namespaces %v, links %v", h.netns, h.links)
+	}
+}
+
+func TestDisposeResources(t *testing.T) {
+	useStateDir(t)
+	h := &fakeHost{}
+
+	s, err := InitResources(network.WithExecutor(context.Background(), newFakeExecutor(h)), parseConfig(t, twoNamespacesConfig), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	e := newFakeExecutor(h)
+	if err := DisposeResources(network.WithExecutor(context.Background(), e), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertTranscript(t, e, []string{
+		"ip netns list",
+		"ip netns delete ayame-test-ns1",
+		"ip netns list",
+		"ip netns delete ayame-test-ns2",
+	})
+
+	if len(h.netns) != 0 || len(h.links) != 0 {
+		t.Errorf("resources are left: namespaces %v, links %v", h.netns, h.links)
+	}
+	if ResourcesSaved("test") {
+		t.Errorf("state of the lab is left")
+	}
+}
+
+const dependentNamespacesConfig = `
+namespaces:
+  - name: ns2
+    depends_on: [ns1]
+    commands:
+      - echo ns2
+  - name: ns1
+    commands:
+      - echo ns1
+    ready_when:
+      - command: test -e /tmp/ready
+`
+
+func TestRestoreResourcesDependencies(t *testing.T) {
+	useStateDir(t)
+
+	s, err := InitResources(network.WithExecutor(context.Background(), newFakeExecutor(&fakeHost{})), parseConfig(t, dependentNamespacesConfig), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The namespaces have gone after reboot.
+	e := newFakeExecutor(&fakeHost{})
+	if _, err := RestoreResources(network.WithExecutor(context.Background(), e), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertTranscript(t, e, []string{
+		"ip netns list",
+		"ip netns add ayame-test-ns2",
+		"ip netns list",
+		"ip netns add ayame-test-ns1",
+		"ip netns exec ayame-test-ns1 echo ns1",
+		"ip netns exec ayame-test-ns1 test -e /tmp/ready",
+		"ip netns exec ayame-test-ns2 echo ns2",
+	})
+}
+
+func TestRestoreResourcesVethEnds(t *testing.T) {
+	useStateDir(t)
+	h := &fakeHost{}
+
+	cfg := parseConfig(t, twoNamespacesConfig+`
+hooks:
+  pre_create:
+    - echo pre
+  post_create:
+    - echo post
+`)
+	s, err := InitResources(network.WithExecutor(context.Background(), newFakeExecutor(h)), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the left end is where it was.
+	delete(h.links, "71e5-veth1-r")
+
+	e := newFakeExecutor(h)
+	if _, err := RestoreResources(network.WithExecutor(context.Background(), e), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hooks aren't run, and the pair is created again after the left end is deleted.
+	assertTranscript(t, e, []string{
+		"ip netns list",
+		"ip netns list",
+		"ip netns list",
+		"ip -n ayame-test-ns1 link show dev 71e5-veth1-l",
+		"ip netns list",
+		"ip -n ayame-test-ns2 link show dev 71e5-veth1-r",
+		"ip netns exec ayame-test-ns1 ip link delete 71e5-veth1-l",
+		"ip link add name 71e5-veth1-l type veth peer 71e5-veth1-r",
+		"ip link set dev 71e5-veth1-l alias ayame",
+		"ip link set dev 71e5-veth1-r alias ayame",
+		"ip link set 71e5-veth1-l netns ayame-test-ns1",
+		"ip netns exec ayame-test-ns1 ip addr add 10.0.0.1/24 dev 71e5-veth1-l",
+		"ip link set 71e5-veth1-r netns ayame-test-ns2",
+		"ip netns exec ayame-test-ns2 ip addr add 10.0.0.2/24 dev 71e5-veth1-r",
+	})
+
+	if h.links["71e5-veth1-l"] != "ayame-test-ns1" || h.links["71e5-veth1-r"] != "ayame-test-ns2" {
+		t.Errorf("veths are not restored: %v", h.links)
+	}
+}
+
+func TestInspectLinkDown(t *testing.T) {
+	useStateDir(t)
+	h := &fakeHost{}
+
+	ctx := network.WithExecutor(context.Background(), newFakeExecutor(h))
+	s, err := InitResources(ctx, parseConfig(t, twoNamespacesConfig), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.up["71e5-veth1-r"] = false
+	status := s.Inspect(ctx)
+
+	expected := map[string]string{"ns1/veth1": StatusPresent, "ns2/veth1": StatusDown}
+	for _, r := range status.Resources {
+		if want, ok := expected[r.Name]; ok && r.Kind == "device" && r.Status != want {
+			t.Errorf("expected %s to be %s, actual %s", r.Name, want, r.Status)
+		}
+	}
+	if !status.Drift {
+		t.Error("drift isn't detected")
+	}
+}
+
+func TestFindOrphansWithoutOvs(t *testing.T) {
+	useStateDir(t)
+
+	for _, installed := range []bool{true, false} {
+		h := &fakeHost{}
+		e := &network.FakeExecutor{Respond: func(cmd *network.Command) (string, error) {
+			switch {
+			case cmd.Name != "ovs-vsctl":
+				return h.respond(cmd)
+			case !installed:
+				return "", fmt.Errorf("executable file not found in $PATH")
+			case cmd.Args[0] == "--bare":
+				return "1234-br1\n", nil
+			}
+			return "", nil
+		}}
+
+		orphans, err := FindOrphans(network.WithExecutor(context.Background(), e))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var expected []Orphan
+		if installed {
+			expected = []Orphan{{Kind: "bridge", Name: "1234-br1"}}
+		}
+		if !reflect.DeepEqual(orphans, expected) {
+			t.Errorf("ovs-vsctl installed %t: expected %v, actual %v", installed, expected, orphans)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package state
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+const (
+	StatusPresent  = "present"
+	StatusMissing  = "missing"
+	StatusModified = "modified"
+	// StatusDown means the device has the address but is administratively down.
+	StatusDown = "down"
+	// StatusUnknown means the kernel couldn't be queried.
+	StatusUnknown = "unknown"
+)
+
+// ResourceStatus is a saved resource compared with the kernel.
+type ResourceStatus struct {
+	Kind   string `json:"kind" yaml:"kind"`
+	Name   string `json:"name" yaml:"name"`
+	Status string `json:"status" yaml:"status"`
+	State  string `json:"state,omitempty" yaml:"state,omitempty"`
+	Detail string `json:"detail,omitempty" yaml:"detail,omitempty"`
+}
+
+// LiveStatus is the result of Inspect. Drift is true if any resource is missing, modified or down.
+type LiveStatus struct {
+	Drift     bool             `json:"drift" yaml:"drift"`
+	Resources []ResourceStatus `json:"resources" yaml:"resources"`
+}
+
+type inspector struct {
+	ctx    context.Context
+	status *LiveStatus
+	netns  map[string]bool
+	links  map[string]map[string]network.LinkInfo
+}
+
+// Inspect queries the kernel and OpenvSwitch for all the saved resources.
+func (s *State) Inspect(ctx context.Context) *LiveStatus {
+	s.RefreshServices()
+
+	in := &inspector{
+		ctx:    ctx,
+		status: &LiveStatus{},
+		netns:  network.ListNetns(ctx),
+		links:  make(map[string]map[string]network.LinkInfo),
+	}
+
+	for _, n := range s.Namespaces {
+		in.inspectNamespace(n)
+	}
+	for _, name := range sortedDirectLinks(s.DirectLinks) {
+		in.inspectDirectLink(s.DirectLinks[name], s.Namespaces)
+	}
+	for _, name := range sortedBridges(s.Bridges) {
+		in.inspectBridge(s.Bridges[name])
+	}
+
+	return in.status
+}
+
+func (in *inspector) add(kind string, name string, status string, state string, detail string) {
+	in.status.Resources = append(in.status.Resources, ResourceStatus{
+		Kind:   kind,
+		Name:   name,
+		Status: status,
+		State:  state,
+		Detail: detail,
+	})
+
+	if status == StatusMissing || status == StatusModified || status == StatusDown {
+		in.status.Drift = true
+	}
+}
+
+// nsLinks returns the interfaces in the namespace, or on the host if nsname is empty.
+func (in *inspector) nsLinks(nsname string) (map[string]network.LinkInfo, error) {
+	if links, ok := in.links[nsname]; ok {
+		return links, nil
+	}
+
+	links, err := network.ListLinks(in.ctx, nsname)
+	if err != nil {
+		return nil, err
+	}
+	in.links[nsname] = links
+	return links, nil
+}
+
+func (in *inspector) inspectNamespace(n *network.Namespace) {
+	if !in.netns[n.NetnsName()] {
+		in.add("namespace", n.Name, StatusMissing, "", "")
+		for _, dev := range n.RegisteredDeviceConfig {
+			in.add("device", n.Name+"/"+dev.Name, StatusMissing, "", "namespace is missing")
+		}
+		for _, route := range n.Routes {
+			in.add("route", n.Name+" "+route.String(), StatusMissing, "", "namespace is missing")
+		}
+		in.inspectServices(n)
+		return
+	}
+	in.add("namespace", n.Name, StatusPresent, "", "")
+
+	links, err := in.nsLinks(n.NetnsName())
+	for _, dev := range n.RegisteredDeviceConfig {
+		name := n.Name + "/" + dev.Name
+		switch {
+		case len(dev.AttachedVeth) == 0:
+			in.add("device", name, StatusMissing, "", "not attached")
+		case err != nil:
+			in.add("device", name, StatusUnknown, "", err.Error())
+		default:
+			in.inspectDevice(name, dev, links)
+		}
+	}
+
+	in.inspectRoutes(n)
+	in.inspectServices(n)
+}
+
+func (in *inspector) inspectDevice(name string, dev network.RegisteredDeviceConfig, links map[string]network.LinkInfo) {
+	link, ok := links[dev.AttachedVeth]
+	if !ok {
+		in.add("device", name, StatusMissing, "", dev.AttachedVeth+" not found")
+		return
+	}
+
+	for _, cidr := range link.Cidrs {
+		if cidr != dev.Cidr {
+			continue
+		}
+		if !link.Up {
+			in.add("device", name, StatusDown, link.OperState, dev.AttachedVeth+" "+dev.Cidr+" is administratively down")
+			return
+		}
+		in.add("device", name, StatusPresent, link.OperState, dev.AttachedVeth+" "+dev.Cidr)
+		return
+	}
+
+	has := "no address"
+	if len(link.Cidrs) != 0 {
+		has = strings.Join(link.Cidrs, ", ")
+	}
+	in.add("device", name, StatusModified, link.OperState,
+		fmt.Sprintf("%s doesn't have %s (has %s)", dev.AttachedVeth, dev.Cidr, has))
+}
+
+func (in *inspector) inspectRoutes(n *network.Namespace) {
+	if len(n.Routes) == 0 {
+		return
+	}
+
+	routes, err := network.ListRoutes(in.ctx, n.NetnsName())
+	for _, route := range n.Routes {
+		name := n.Name + " " + route.String()
+		if err != nil {
+			in.add("route", name, StatusUnknown, "", err.Error())
+			continue
+		}
+
+		if routeExists(n, route, routes) {
+			in.add("route", name, StatusPresent, "", "")
+		} else {
+			in.add("route", name, StatusMissing, "", "")
+		}
+	}
+}
+
+func routeExists(n *network.Namespace, route config.RouteConfig, routes []network.RouteInfo) bool {
+	to := network.NormalizeRouteDestination(route.To)
+	for _, r := range routes {
+		if r.To != to {
+			continue
+		}
+		if route.Via != "" && r.Via != route.Via {
+			continue
+		}
+		if route.Device != "" {
+			if ifname, err := n.DeviceIfname(route.Device); err != nil || r.Device != ifname {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (in *inspector) inspectServices(n *network.Namespace) {
+	for _, svc := range n.Services {
+		name := n.Name + "/" + svc.Name
+		if svc.Status == network.ServiceRunning {
+			in.add("service", name, StatusPresent, svc.Status, fmt.Sprintf("pid %d", svc.PID))
+		} else {
+			in.add("service", name, StatusMissing, svc.Status, fmt.Sprintf("pid %d", svc.PID))
+		}
+	}
+}
+
+func (in *inspector) inspectDirectLink(d *network.DirectLink, nss []*network.Namespace) {
+	found := 0
+	var details []string
+	for _, veth := range []network.Veth{d.VethPair.Left, d.VethPair.Right} {
+		where := ""
+		if veth.Attached {
+			for _, n := range nss {
+				if n.HasAttached(veth.Name) {
+					where = n.NetnsName()
+				}
+			}
+			if where == "" || !in.netns[where] {
+				details = append(details, veth.Name+" not found")
+				continue
+			}
+		}
+
+		links, err := in.nsLinks(where)
+		if err != nil {
+			in.add("direct_link", d.Name, StatusUnknown, "", err.Error())
+			return
+		}
+		if _, ok := links[veth.Name]; ok {
+			found++
+		} else {
+			details = append(details, veth.Name+" not found")
+		}
+	}
+
+	switch found {
+	case 2:
+		in.add("direct_link", d.Name, StatusPresent, "", "")
+	case 0:
+		in.add("direct_link", d.Name, StatusMissing, "", "")
+	default:
+		in.add("direct_link", d.Name, StatusModified, "", strings.Join(details, ", "))
+	}
+}
+
+func (in *inspector) inspectBridge(br *network.Bridge) {
+	exists, err := network.BridgeExists(in.ctx, br.OvsName())
+	if err != nil {
+		in.add("bridge", br.Name, StatusUnknown, "", err.Error())
+		return
+	}
+	if !exists {
+		in.add("bridge", br.Name, StatusMissing, "", "")
+		for _, p := range br.VethPairs {
+			in.add("bridge_port", br.Name+"/"+p.Right.Name, StatusMissing, "", "bridge is missing")
+		}
+		return
+	}
+	in.add("bridge", br.Name, StatusPresent, "", "")
+
+	ports, err := network.ListBridgePorts(in.ctx, br.OvsName())
+	for _, p := range br.VethPairs {
+		name := br.Name + "/" + p.Right.Name
+		switch {
+		case err != nil:
+			in.add("bridge_port", name, StatusUnknown, "", err.Error())
+		case ports[p.Right.Name]:
+			in.add("bridge_port", name, StatusPresent, "", "")
+		default:
+			in.add("bridge_port", name, StatusMissing, "", "")
+		}
+	}
+}